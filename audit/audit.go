@@ -0,0 +1,180 @@
+package audit
+
+import (
+	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"github.com/mrbbot/gift-list-api/event"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"firebase.google.com/go/auth"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	EntityList   = "list"
+	EntityGift   = "gift"
+	EntityFriend = "friend"
+
+	// System is the actor recorded for changes the server makes by itself.
+	System = "system"
+)
+
+type Entry struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor,omitempty"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	EntityID  int64           `json:"entityId"`
+	Owner     string          `json:"owner"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+	Created   time.Time       `json:"created"`
+	Redacted  bool            `json:"redacted,omitempty"`
+}
+
+func marshal(v interface{}) (sql.NullString, error) {
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// Record appends an entry to the audit log. owner is the user whose data was
+// changed: the list owner for lists and gifts, or the other user for
+// friendships. Failures are logged rather than returned, since the change has
+// already been made by the time it's recorded.
+func Record(db *sql.DB, r *http.Request, actor string, action string, entity string, entityId int64, owner string, before interface{}, after interface{}) {
+	err := record(db, r, actor, action, entity, entityId, owner, before, after)
+	if err != nil {
+		log.Printf("error recording %s on %s %d: %v\n", action, entity, entityId, err)
+	}
+}
+
+func record(db *sql.DB, r *http.Request, actor string, action string, entity string, entityId int64, owner string, before interface{}, after interface{}) error {
+	beforeJson, err := marshal(before)
+	if err != nil {
+		return err
+	}
+	afterJson, err := marshal(after)
+	if err != nil {
+		return err
+	}
+
+	// The entry is written even if the client has gone away, as the change has
+	// already been made
+	ctx := context.Background()
+	requestId := ""
+	if r != nil {
+		ctx = context.WithoutCancel(r.Context())
+		requestId = util.RequestID(r)
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO audit_log (actor, action, entity, entity_id, owner, before_json, after_json, request_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		actor, action, entity, entityId, owner, beforeJson, afterJson, requestId, time.Now().UTC())
+	return err
+}
+
+// GetAudit returns audit entries, newest first. Admins can see every entry,
+// other users only the ones about their own data or made by themselves. Who
+// claimed what is hidden from list owners.
+func GetAudit(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	admin := authHelper.IsAdmin(user)
+
+	sqlQuery := "SELECT id, actor, action, entity, entity_id, owner, before_json, after_json, request_id, created_at FROM audit_log WHERE 1 = 1"
+	var args []interface{}
+	if !admin {
+		sqlQuery += " AND (owner = ? OR actor = ?)"
+		args = append(args, user.UID, user.UID)
+	}
+	for _, filter := range []struct{ param, column string }{
+		{"entity", "entity"},
+		{"entityId", "entity_id"},
+		{"action", "action"},
+		{"actor", "actor"},
+		{"owner", "owner"},
+		{"requestId", "request_id"},
+	} {
+		if value := query.Get(filter.param); len(value) > 0 {
+			sqlQuery += " AND " + filter.column + " = ?"
+			args = append(args, value)
+		}
+	}
+	for _, filter := range []struct{ param, op string }{
+		{"since", ">="},
+		{"until", "<"},
+	} {
+		if value := query.Get(filter.param); len(value) > 0 {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				util.EncodeBadRequest(w, filter.param+" must be an RFC 3339 time")
+				return
+			}
+			sqlQuery += " AND created_at " + filter.op + " ?"
+			args = append(args, t.UTC())
+		}
+	}
+
+	if page.Cursor != 0 {
+		sqlQuery += " AND id < ?"
+		args = append(args, page.Cursor)
+	}
+	sqlQuery += " ORDER BY id DESC LIMIT ?"
+	args = append(args, page.Limit)
+
+	rows, err := db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var (
+			entry         Entry
+			before, after sql.NullString
+		)
+		err := rows.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.Entity, &entry.EntityID, &entry.Owner, &before, &after, &entry.RequestID, &entry.Created)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+
+		if !admin && entry.Owner == user.UID && (event.Event{Type: entry.Action}).IsClaim() {
+			entry.Actor = ""
+			entry.Before = nil
+			entry.After = nil
+			entry.Redacted = true
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(entries), entries[len(entries)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -1,17 +1,23 @@
 package auth
 
 import (
+	"github.com/mrbbot/gift-list-api/metrics"
+	"context"
 	"firebase.google.com/go"
 	"firebase.google.com/go/auth"
-	"golang.org/x/net/context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/option"
 	"log"
+	"time"
 )
 
 var client *auth.Client
 
-func Init() {
-	opt := option.WithCredentialsFile("./serviceAccountKey.json")
+// Init connects to Firebase with the service account key at credentialsPath.
+func Init(credentialsPath string) {
+	opt := option.WithCredentialsFile(credentialsPath)
 	app, err := firebase.NewApp(context.Background(), nil, opt)
 	if err != nil {
 		log.Fatalf("error initializing firebase: %v\n", err)
@@ -23,18 +29,81 @@ func Init() {
 	}
 }
 
-func Verify(idToken string) (*auth.Token, error) {
-	token, err := client.VerifyIDToken(context.Background(), idToken)
+var (
+	calls    = metrics.NewHistogram("firebase_request_duration_seconds", "Time taken by Firebase calls, by method.", metrics.DefaultBuckets, "method")
+	failures = metrics.NewCounter("firebase_errors_total", "Firebase calls that failed, by method. Invalid tokens and unknown users aren't counted.", "method")
+)
+
+var tracer = otel.Tracer("github.com/mrbbot/gift-list-api/auth")
+
+// call times a Firebase call for metrics and traces it.
+type call struct {
+	method string
+	start  time.Time
+	span   trace.Span
+}
+
+func startCall(ctx context.Context, method string) (context.Context, *call) {
+	ctx, span := tracer.Start(ctx, "firebase."+method, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, &call{method: method, start: time.Now(), span: span}
+}
+
+// end records how long the call took, and counts it as an error if Firebase
+// couldn't give an answer. Answers like an unknown user are expected errors.
+func (c *call) end(err error, expected func(error) bool) {
+	calls.Observe(time.Since(c.start).Seconds(), c.method)
+	if err != nil {
+		c.span.RecordError(err)
+		if !expected(err) {
+			failures.Inc(c.method)
+			c.span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	c.span.End()
+}
+
+// Verify checks idToken with Firebase. ctx is usually the request's context,
+// so the call is given up on if the client goes away.
+func Verify(ctx context.Context, idToken string) (*auth.Token, error) {
+	ctx, c := startCall(ctx, "verify")
+	token, err := client.VerifyIDToken(ctx, idToken)
+	// Bad tokens are the client's problem, but running out of time isn't
+	c.end(err, func(err error) bool {
+		return ctx.Err() == nil
+	})
 	if err != nil {
 		return nil, err
 	}
 	return token, nil
 }
 
-func UserFromUID(uid string) (*auth.UserRecord, error) {
-	return client.GetUser(context.Background(), uid)
+func UserFromUID(ctx context.Context, uid string) (*auth.UserRecord, error) {
+	ctx, c := startCall(ctx, "get_user")
+	user, err := client.GetUser(ctx, uid)
+	c.end(err, auth.IsUserNotFound)
+	return user, err
+}
+
+func UserFromEmail(ctx context.Context, email string) (*auth.UserRecord, error) {
+	ctx, c := startCall(ctx, "get_user_by_email")
+	user, err := client.GetUserByEmail(ctx, email)
+	c.end(err, auth.IsUserNotFound)
+	return user, err
+}
+
+// Ping checks that Firebase is answering by looking up a user that doesn't
+// exist.
+func Ping(ctx context.Context) error {
+	_, err := UserFromUID(ctx, "readiness-check")
+	if err != nil && !auth.IsUserNotFound(err) {
+		return err
+	}
+	return nil
 }
 
-func UserFromEmail(email string) (*auth.UserRecord, error) {
-	return client.GetUserByEmail(context.Background(), email)
+// IsAdmin reports whether the token carries the admin custom claim, set with
+// the Firebase Admin SDK.
+func IsAdmin(token *auth.Token) bool {
+	admin, ok := token.Claims["admin"].(bool)
+	return ok && admin
 }
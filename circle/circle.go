@@ -0,0 +1,393 @@
+package circle
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"firebase.google.com/go/auth"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a list is shared with a circle that doesn't
+// exist or belongs to someone else.
+var ErrNotFound = errors.New("circle not found")
+
+var errShared = errors.New("circle is shared with lists")
+
+// Circle is a named group of a user's friends, such as "Family", that lists
+// can be shared with.
+type Circle struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Members []string  `json:"members"`
+	Created time.Time `json:"created"`
+}
+
+func getCircle(ctx context.Context, db *sql.DB, id string, owner string) (Circle, error) {
+	var circle Circle
+	err := db.QueryRowContext(ctx, "SELECT id, name, created_at FROM circles WHERE id = ? AND owner = ?", id, owner).Scan(&circle.ID, &circle.Name, &circle.Created)
+	if err != nil {
+		return circle, err
+	}
+	circle.Members, err = getMembers(ctx, db, circle.ID)
+	return circle, err
+}
+
+func getMembers(ctx context.Context, db *sql.DB, circleId int64) ([]string, error) {
+	members := []string{}
+	rows, err := db.QueryContext(ctx, "SELECT member FROM circle_members WHERE circle_id = ? ORDER BY member", circleId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member string
+		err := rows.Scan(&member)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// Owns reports whether the circle exists and belongs to owner.
+func Owns(ctx context.Context, db *sql.DB, owner string, circleId interface{}) (bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM circles WHERE id = ? AND owner = ?", circleId, owner)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), nil
+}
+
+// GetListCircles returns the circles a list is shared with, which is empty if
+// all of the owner's friends can see it.
+func GetListCircles(ctx context.Context, db *sql.DB, listId int64) ([]int64, error) {
+	circles := []int64{}
+	rows, err := db.QueryContext(ctx, "SELECT circle_id FROM list_circles WHERE list_id = ? ORDER BY circle_id", listId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var circle int64
+		err := rows.Scan(&circle)
+		if err != nil {
+			return nil, err
+		}
+		circles = append(circles, circle)
+	}
+	return circles, rows.Err()
+}
+
+func unique(circles []int64) map[int64]bool {
+	set := map[int64]bool{}
+	for _, circle := range circles {
+		set[circle] = true
+	}
+	return set
+}
+
+// CheckOwned returns ErrNotFound unless every circle belongs to owner. In a
+// transaction, the circles are locked until it ends so they can't be removed
+// in the meantime.
+func CheckOwned(ctx context.Context, q util.Querier, owner string, circles []int64) error {
+	set := unique(circles)
+	if len(set) == 0 {
+		return nil
+	}
+	args := []interface{}{owner}
+	for circle := range set {
+		args = append(args, circle)
+	}
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM circles WHERE owner = ? AND id IN (?"+strings.Repeat(", ?", len(set)-1)+") LOCK IN SHARE MODE", args...).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != len(set) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetListCircles shares a list with just the given circles, or with all of the
+// owner's friends if there are none. Every circle must belong to owner. No
+// circles means every friend can see the list, so q must be a transaction for
+// the list never to be seen with some of its circles missing.
+func SetListCircles(ctx context.Context, q util.Querier, owner string, listId int64, circles []int64) error {
+	err := CheckOwned(ctx, q, owner, circles)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, "DELETE FROM list_circles WHERE list_id = ?", listId)
+	if err != nil {
+		return err
+	}
+	for circle := range unique(circles) {
+		_, err := q.ExecContext(ctx, "INSERT INTO list_circles (list_id, circle_id) VALUES (?, ?)", listId, circle)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetCircles(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	circles := []Circle{}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, name, created_at FROM circles WHERE owner = ? AND id > ? ORDER BY id LIMIT ?", user.UID, page.Cursor, page.Limit)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var circle Circle
+		err := rows.Scan(&circle.ID, &circle.Name, &circle.Created)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		circles = append(circles, circle)
+	}
+	rows.Close()
+
+	for i := range circles {
+		circles[i].Members, err = getMembers(ctx, db, circles[i].ID)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+	}
+
+	if len(circles) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(circles), circles[len(circles)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(circles)
+}
+
+func CreateCircle(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	var circle Circle
+	json.NewDecoder(r.Body).Decode(&circle)
+	if len(circle.Name) == 0 {
+		util.EncodeBadRequest(w, "name is required")
+		return
+	}
+
+	members := map[string]bool{}
+	for _, member := range circle.Members {
+		areFriends, err := util.AreFriends(ctx, db, user.UID, member)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		if !areFriends || member == user.UID {
+			util.EncodeBadRequest(w, "members must be friends")
+			return
+		}
+		members[member] = true
+	}
+
+	circle.Created = time.Now().UTC()
+	err := util.Transact(ctx, db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "INSERT INTO circles (owner, name, created_at) VALUES (?, ?, ?)", user.UID, circle.Name, circle.Created)
+		if err != nil {
+			return err
+		}
+		circle.ID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for member := range members {
+			_, err := tx.ExecContext(ctx, "INSERT INTO circle_members (circle_id, member) VALUES (?, ?)", circle.ID, member)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	circle.Members, err = getMembers(ctx, db, circle.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(circle)
+}
+
+func EditCircle(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["circleId"]
+
+	circle, err := getCircle(ctx, db, id, user.UID)
+	if err == sql.ErrNoRows {
+		util.EncodeNotFound(w)
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	var newCircle Circle
+	json.NewDecoder(r.Body).Decode(&newCircle)
+	if len(newCircle.Name) > 0 {
+		circle.Name = newCircle.Name
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE circles SET name = ? WHERE id = ?", circle.Name, circle.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(circle)
+}
+
+// RemoveCircle deletes a circle. Circles that lists are shared with can't be
+// removed, as that would make the lists visible to all friends.
+func RemoveCircle(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["circleId"]
+
+	err := util.Transact(ctx, db, func(tx *sql.Tx) error {
+		// Locked so no list can be shared with it until it's gone
+		var circleId int64
+		err := tx.QueryRowContext(ctx, "SELECT id FROM circles WHERE id = ? AND owner = ? FOR UPDATE", id, user.UID).Scan(&circleId)
+		if err != nil {
+			return err
+		}
+
+		var lists int
+		err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM list_circles WHERE circle_id = ?", circleId).Scan(&lists)
+		if err != nil {
+			return err
+		}
+		if lists > 0 {
+			return errShared
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM circle_members WHERE circle_id = ?", circleId)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM circles WHERE id = ?", circleId)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		util.EncodeNotFound(w)
+		return
+	}
+	if err == errShared {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(util.Response{Success: true})
+}
+
+func AddMember(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["circleId"]
+	member := params["userId"]
+
+	owns, err := Owns(ctx, db, user.UID, id)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if !owns {
+		util.EncodeNotFound(w)
+		return
+	}
+	areFriends, err := util.AreFriends(ctx, db, user.UID, member)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if !areFriends || member == user.UID {
+		util.EncodeBadRequest(w, "members must be friends")
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT IGNORE INTO circle_members (circle_id, member) VALUES (?, ?)", id, member)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	circle, err := getCircle(ctx, db, id, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(circle)
+}
+
+func RemoveMember(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["circleId"]
+	member := params["userId"]
+
+	owns, err := Owns(ctx, db, user.UID, id)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if !owns {
+		util.EncodeNotFound(w)
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "DELETE FROM circle_members WHERE circle_id = ? AND member = ?", id, member)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "member not found"})
+	}
+}
@@ -0,0 +1,311 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds everything the server can be configured with. Settings come
+// from, in increasing order of precedence: the defaults, a YAML config file,
+// environment variables (which can be put in a .env file) and command line
+// flags. Each flag's environment variable is in envVars, and the file uses the
+// yaml tags below.
+type Config struct {
+	// Data source name for the MySQL database
+	DB string `yaml:"db"`
+	// Database connection pool limits
+	DBMaxOpenConns    int           `yaml:"dbMaxOpenConns"`
+	DBMaxIdleConns    int           `yaml:"dbMaxIdleConns"`
+	DBConnMaxLifetime time.Duration `yaml:"dbConnMaxLifetime"`
+	// How long to keep trying to reach the database when starting up
+	DBStartupTimeout time.Duration `yaml:"dbStartupTimeout"`
+
+	Address string `yaml:"address"`
+	SSL     bool   `yaml:"ssl"`
+	Cert    string `yaml:"cert"`
+	Key     string `yaml:"key"`
+	// Origins allowed to make cross-origin requests, or "*" for any
+	CORSOrigins []string `yaml:"corsOrigins"`
+	// Server timeouts for reading a whole request, writing a response and
+	// keeping idle connections open
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
+	// How long a request can take before it's cancelled, including the database
+	// queries and Firebase calls it makes, or 0 for no limit. Streams aren't
+	// affected.
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+	// Largest request body accepted, in bytes
+	MaxBodyBytes int64 `yaml:"maxBodyBytes"`
+	// How long requests in progress have to finish when shutting down
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+
+	// Path to the Firebase service account key
+	Credentials string `yaml:"credentials"`
+	// Search backend, either "fulltext" or "scan"
+	Search string `yaml:"search"`
+	// How long friend requests wait to be answered, or 0 to keep them forever
+	FriendRequestExpiry time.Duration `yaml:"friendRequestExpiry"`
+
+	// Requests allowed per minute from each IP address and from each user, and
+	// per hour for adding friends and claiming gifts. 0 turns a limit off.
+	IPRateLimit     int `yaml:"ipRateLimit"`
+	UserRateLimit   int `yaml:"userRateLimit"`
+	FriendRateLimit int `yaml:"friendRateLimit"`
+	ClaimRateLimit  int `yaml:"claimRateLimit"`
+	// Whether the server is behind a proxy that appends the client's address to
+	// X-Forwarded-For
+	TrustProxy bool `yaml:"trustProxy"`
+
+	// Where to export trace spans: "none", "stdout" or "otlp"
+	Tracing string `yaml:"tracing"`
+	// OTLP/HTTP collector address, used with the otlp exporter
+	OTLPEndpoint string `yaml:"otlpEndpoint"`
+}
+
+// Default returns the configuration used for anything that isn't set.
+func Default() Config {
+	return Config{
+		DBMaxOpenConns:      25,
+		DBMaxIdleConns:      25,
+		DBConnMaxLifetime:   5 * time.Minute,
+		DBStartupTimeout:    30 * time.Second,
+		Address:             ":8080",
+		CORSOrigins:         []string{"*"},
+		ReadTimeout:         15 * time.Second,
+		WriteTimeout:        30 * time.Second,
+		IdleTimeout:         2 * time.Minute,
+		RequestTimeout:      10 * time.Second,
+		MaxBodyBytes:        1 << 20,
+		ShutdownTimeout:     30 * time.Second,
+		Credentials:         "./serviceAccountKey.json",
+		Search:              "fulltext",
+		FriendRequestExpiry: 30 * 24 * time.Hour,
+		IPRateLimit:         600,
+		UserRateLimit:       300,
+		FriendRateLimit:     30,
+		ClaimRateLimit:      120,
+		Tracing:             "none",
+		OTLPEndpoint:        "localhost:4318",
+	}
+}
+
+// envVars are the environment variables that can be used instead of each flag.
+var envVars = map[string]string{
+	"config":                "CONFIG",
+	"db":                    "DB",
+	"db-max-open-conns":     "DB_MAX_OPEN_CONNS",
+	"db-max-idle-conns":     "DB_MAX_IDLE_CONNS",
+	"db-conn-max-lifetime":  "DB_CONN_MAX_LIFETIME",
+	"db-startup-timeout":    "DB_STARTUP_TIMEOUT",
+	"address":               "ADDRESS",
+	"ssl":                   "SSL",
+	"cert":                  "CERT",
+	"key":                   "KEY",
+	"cors-origins":          "CORS_ORIGINS",
+	"read-timeout":          "READ_TIMEOUT",
+	"write-timeout":         "WRITE_TIMEOUT",
+	"idle-timeout":          "IDLE_TIMEOUT",
+	"request-timeout":       "REQUEST_TIMEOUT",
+	"max-body-bytes":        "MAX_BODY_BYTES",
+	"shutdown-timeout":      "SHUTDOWN_TIMEOUT",
+	"credentials":           "CREDENTIALS",
+	"search":                "SEARCH",
+	"friend-request-expiry": "FRIEND_REQUEST_EXPIRY",
+	"ip-rate-limit":         "IP_RATE_LIMIT",
+	"user-rate-limit":       "USER_RATE_LIMIT",
+	"friend-rate-limit":     "FRIEND_RATE_LIMIT",
+	"claim-rate-limit":      "CLAIM_RATE_LIMIT",
+	"trust-proxy":           "TRUST_PROXY",
+	"tracing":               "TRACING",
+	"otlp-endpoint":         "OTLP_ENDPOINT",
+}
+
+// list is a comma separated flag value.
+type list struct {
+	values *[]string
+}
+
+func (l list) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l list) Set(value string) error {
+	*l.values = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			*l.values = append(*l.values, item)
+		}
+	}
+	return nil
+}
+
+// flagSet returns flags that set the fields of config, and the config file path.
+func flagSet(config *Config, file *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("gift-list-api", flag.ContinueOnError)
+	fs.StringVar(file, "config", *file, "path to a YAML config file")
+	fs.StringVar(&config.DB, "db", config.DB, "MySQL data source name (required)")
+	fs.IntVar(&config.DBMaxOpenConns, "db-max-open-conns", config.DBMaxOpenConns, "maximum open database connections, 0 for no limit")
+	fs.IntVar(&config.DBMaxIdleConns, "db-max-idle-conns", config.DBMaxIdleConns, "maximum idle database connections")
+	fs.DurationVar(&config.DBConnMaxLifetime, "db-conn-max-lifetime", config.DBConnMaxLifetime, "how long a database connection can be reused for, 0 for ever")
+	fs.DurationVar(&config.DBStartupTimeout, "db-startup-timeout", config.DBStartupTimeout, "how long to keep trying to reach the database when starting up")
+	fs.StringVar(&config.Address, "address", config.Address, "address to listen on")
+	fs.BoolVar(&config.SSL, "ssl", config.SSL, "serve HTTPS using cert and key")
+	fs.StringVar(&config.Cert, "cert", config.Cert, "TLS certificate path, required with ssl")
+	fs.StringVar(&config.Key, "key", config.Key, "TLS key path, required with ssl")
+	fs.Var(list{&config.CORSOrigins}, "cors-origins", "comma separated origins allowed to make cross-origin requests, * for any")
+	fs.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "time allowed to read a whole request")
+	fs.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "time allowed to write a response")
+	fs.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "time idle keep-alive connections are kept open")
+	fs.DurationVar(&config.RequestTimeout, "request-timeout", config.RequestTimeout, "time a request can take before it's cancelled, 0 for no limit")
+	fs.Int64Var(&config.MaxBodyBytes, "max-body-bytes", config.MaxBodyBytes, "largest request body accepted, in bytes")
+	fs.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "time requests in progress have to finish when shutting down")
+	fs.StringVar(&config.Credentials, "credentials", config.Credentials, "Firebase service account key path")
+	fs.StringVar(&config.Search, "search", config.Search, "search backend, fulltext or scan")
+	fs.DurationVar(&config.FriendRequestExpiry, "friend-request-expiry", config.FriendRequestExpiry, "how long friend requests wait to be answered, 0 to keep them forever")
+	fs.IntVar(&config.IPRateLimit, "ip-rate-limit", config.IPRateLimit, "requests allowed per minute from each IP address, 0 for no limit")
+	fs.IntVar(&config.UserRateLimit, "user-rate-limit", config.UserRateLimit, "requests allowed per minute from each user, 0 for no limit")
+	fs.IntVar(&config.FriendRateLimit, "friend-rate-limit", config.FriendRateLimit, "friends each user can add per hour, 0 for no limit")
+	fs.IntVar(&config.ClaimRateLimit, "claim-rate-limit", config.ClaimRateLimit, "claims each user can make per hour, 0 for no limit")
+	fs.BoolVar(&config.TrustProxy, "trust-proxy", config.TrustProxy, "take client addresses from X-Forwarded-For, set by a proxy in front of the server")
+	fs.StringVar(&config.Tracing, "tracing", config.Tracing, "trace exporter, none, stdout or otlp")
+	fs.StringVar(&config.OTLPEndpoint, "otlp-endpoint", config.OTLPEndpoint, "OTLP/HTTP collector address, used with the otlp exporter")
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Usage += " ($" + envVars[f.Name] + ")"
+	})
+	return fs
+}
+
+// Load reads the configuration from all of its sources and validates it. args
+// are the command line arguments without the program name. A missing .env file
+// is fine, but a config file that's been asked for has to exist.
+func Load(args []string) (Config, error) {
+	err := godotenv.Load()
+	if err != nil && !os.IsNotExist(err) {
+		return Config{}, fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	// The flags are parsed once just to find the config file, as it has to be
+	// read before the environment and flags are applied over it
+	probe := Default()
+	file := os.Getenv("CONFIG")
+	err = flagSet(&probe, &file).Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config := Default()
+	if len(file) > 0 {
+		err = loadFile(&config, file)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	fs := flagSet(&config, &file)
+	for name, env := range envVars {
+		if value, ok := os.LookupEnv(env); ok && name != "config" {
+			err := fs.Lookup(name).Value.Set(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %v", env, err)
+			}
+		}
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// DATETIME columns are scanned straight into time.Time, which only works if
+	// the driver parses them, so it's turned on whether or not the DSN asks
+	if dsn, err := mysql.ParseDSN(config.DB); err == nil {
+		dsn.ParseTime = true
+		config.DB = dsn.FormatDSN()
+	}
+
+	return config, config.Validate()
+}
+
+func loadFile(config *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %v", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks that everything required is set and that the values make
+// sense, reporting every problem at once.
+func (config Config) Validate() error {
+	var problems []string
+	if len(config.DB) == 0 {
+		problems = append(problems, "db is required")
+	} else if dsn, err := mysql.ParseDSN(config.DB); err != nil {
+		problems = append(problems, fmt.Sprintf("db is invalid: %v", err))
+	} else if !dsn.ParseTime {
+		problems = append(problems, "db must set parseTime=true")
+	}
+	if config.DBMaxOpenConns < 0 || config.DBMaxIdleConns < 0 {
+		problems = append(problems, "database pool sizes can't be negative")
+	}
+	if config.DBConnMaxLifetime < 0 || config.DBStartupTimeout < 0 {
+		problems = append(problems, "database timeouts can't be negative")
+	}
+	if len(config.Address) == 0 {
+		problems = append(problems, "address is required")
+	}
+	if config.SSL && (len(config.Cert) == 0 || len(config.Key) == 0) {
+		problems = append(problems, "cert and key are required with ssl")
+	}
+	if len(config.CORSOrigins) == 0 {
+		problems = append(problems, "cors-origins needs at least one origin")
+	}
+	if config.ReadTimeout < 0 || config.WriteTimeout < 0 || config.IdleTimeout < 0 || config.RequestTimeout < 0 || config.ShutdownTimeout < 0 {
+		problems = append(problems, "timeouts can't be negative")
+	}
+	if config.MaxBodyBytes <= 0 {
+		problems = append(problems, "max-body-bytes must be positive")
+	}
+	if _, err := os.Stat(config.Credentials); err != nil {
+		problems = append(problems, fmt.Sprintf("credentials file can't be read: %v", err))
+	}
+	if config.Search != "fulltext" && config.Search != "scan" {
+		problems = append(problems, "search must be fulltext or scan")
+	}
+	if config.FriendRequestExpiry < 0 {
+		problems = append(problems, "friend-request-expiry can't be negative")
+	}
+	if config.IPRateLimit < 0 || config.UserRateLimit < 0 || config.FriendRateLimit < 0 || config.ClaimRateLimit < 0 {
+		problems = append(problems, "rate limits can't be negative")
+	}
+	if config.Tracing != "none" && config.Tracing != "stdout" && config.Tracing != "otlp" {
+		problems = append(problems, "tracing must be none, stdout or otlp")
+	}
+	if config.Tracing == "otlp" && len(config.OTLPEndpoint) == 0 {
+		problems = append(problems, "otlp-endpoint is required with otlp tracing")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package event
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	ListCreated = "list.created"
+	ListUpdated = "list.updated"
+	ListDeleted = "list.deleted"
+
+	ListArchived = "list.archived"
+	ListRestored = "list.restored"
+
+	GiftCreated   = "gift.created"
+	GiftUpdated   = "gift.updated"
+	GiftDeleted   = "gift.deleted"
+	GiftClaimed   = "gift.claimed"
+	GiftUnclaimed = "gift.unclaimed"
+	GiftArchived  = "gift.archived"
+	GiftRestored  = "gift.restored"
+	GiftReceived  = "gift.received"
+
+	FriendRequested = "friend.requested"
+	FriendAccepted  = "friend.accepted"
+	FriendRejected  = "friend.rejected"
+	FriendCancelled = "friend.cancelled"
+	FriendRemoved   = "friend.removed"
+	FriendRestored  = "friend.restored"
+
+	ReminderOccasion = "reminder.occasion"
+	ReminderPurchase = "reminder.purchase"
+)
+
+var Types = []string{
+	ListCreated, ListUpdated, ListDeleted, ListArchived, ListRestored,
+	GiftCreated, GiftUpdated, GiftDeleted, GiftClaimed, GiftUnclaimed, GiftArchived, GiftRestored, GiftReceived,
+	FriendRequested, FriendAccepted, FriendRejected, FriendCancelled, FriendRemoved, FriendRestored,
+	ReminderOccasion, ReminderPurchase,
+}
+
+type Event struct {
+	Type   string      `json:"type"`
+	Time   time.Time   `json:"time"`
+	Actor  string      `json:"actor"`
+	Owner  string      `json:"owner,omitempty"`
+	Target string      `json:"target,omitempty"`
+	ListID int64       `json:"listId,omitempty"`
+	Data   interface{} `json:"data"`
+}
+
+var (
+	mu          sync.RWMutex
+	subscribers []func(Event)
+)
+
+func IsType(t string) bool {
+	for _, known := range Types {
+		if known == t {
+			return true
+		}
+	}
+	return false
+}
+
+// IsClaim reports whether the event reveals who has claimed a gift, in which
+// case it must never be shown to the owner of the list.
+func (e Event) IsClaim() bool {
+	return e.Type == GiftClaimed || e.Type == GiftUnclaimed
+}
+
+func (e Event) IsFriend() bool {
+	return e.Type == FriendRequested || e.Type == FriendAccepted || e.Type == FriendRejected || e.Type == FriendCancelled || e.Type == FriendRemoved || e.Type == FriendRestored
+}
+
+// Subscribe registers f to be called with every published event. Events can
+// outlive the request that published them, so f shouldn't use its context.
+func Subscribe(f func(Event)) {
+	mu.Lock()
+	defer mu.Unlock()
+	subscribers = append(subscribers, f)
+}
+
+// IsReminder reports whether the event is a reminder meant only for its target.
+func (e Event) IsReminder() bool {
+	return e.Type == ReminderOccasion || e.Type == ReminderPurchase
+}
+
+// Publish hands the event to every subscriber without blocking the caller.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, f := range subscribers {
+		go f(e)
+	}
+}
+
+// Audience returns the UIDs of the users allowed to see the event: the target
+// of a reminder, both sides of a friend event (just the actor if there's no
+// target, so they can be kept from the other side, and just the target of a
+// request or its cancellation, as they'd tell the requester whether the email
+// they used belongs to anyone), otherwise the list owner and
+// their friends who can see the list, with the owner left out of claim events.
+// The parent of a managed profile is treated like the owner.
+func Audience(ctx context.Context, db *sql.DB, e Event) ([]string, error) {
+	if e.IsReminder() {
+		return []string{e.Target}, nil
+	}
+	if e.Type == FriendRequested || e.Type == FriendCancelled {
+		if len(e.Target) == 0 {
+			return nil, nil
+		}
+		return []string{e.Target}, nil
+	}
+	if e.IsFriend() {
+		if len(e.Target) == 0 {
+			return []string{e.Actor}, nil
+		}
+		return []string{e.Actor, e.Target}, nil
+	}
+
+	var (
+		friends []string
+		err     error
+	)
+	if e.ListID != 0 {
+		friends, err = util.GetListViewers(ctx, db, e.Owner, e.ListID)
+	} else {
+		friends, err = util.GetFriends(ctx, db, e.Owner)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.IsClaim() {
+		return friends, nil
+	}
+	manager, err := util.GetManager(ctx, db, e.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if manager != e.Owner {
+		friends = append(friends, manager)
+	}
+	return append(friends, e.Owner), nil
+}
@@ -0,0 +1,201 @@
+package feed
+
+import (
+	"github.com/mrbbot/gift-list-api/event"
+	"github.com/mrbbot/gift-list-api/profile"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"firebase.google.com/go/auth"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Gifts added to the same list by the same user within this long of each other
+// are shown as a single item.
+const groupWindow = time.Hour
+
+type Item struct {
+	ID         int64     `json:"id"`
+	Type       string    `json:"type"`
+	Actor      string    `json:"actor"`
+	ActorName  string    `json:"actorName,omitempty"`
+	ActorPhoto string    `json:"actorPhoto,omitempty"`
+	ListID     int64     `json:"listId,omitempty"`
+	ListName   string    `json:"listName,omitempty"`
+	Friend     string    `json:"friend,omitempty"`
+	FriendName string    `json:"friendName,omitempty"`
+	Count      int       `json:"count"`
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+}
+
+// Init subscribes to the events that appear in friends' feeds. Claims are
+// never added, so they can't leak to list owners. Lists and gifts are shown as
+// added by the list owner, so a managed profile's appear as theirs rather than
+// their parent's.
+func Init(db *sql.DB) {
+	ctx := context.Background()
+	event.Subscribe(func(e event.Event) {
+		var err error
+		switch e.Type {
+		case event.ListCreated:
+			err = insert(ctx, db, e.Type, e.Owner, e.Owner, e.ListID, "")
+		case event.GiftCreated:
+			err = addGift(ctx, db, e)
+		case event.FriendAccepted:
+			// Each user's friends see that they have a new friend
+			err = insert(ctx, db, e.Type, e.Actor, e.Actor, 0, e.Target)
+			if err == nil {
+				err = insert(ctx, db, e.Type, e.Target, e.Target, 0, e.Actor)
+			}
+		}
+		if err != nil {
+			log.Printf("error adding %s to feed: %v\n", e.Type, err)
+		}
+	})
+}
+
+func insert(ctx context.Context, db *sql.DB, eventType string, actor string, owner string, listId int64, friend string) error {
+	now := time.Now().UTC()
+	var list interface{}
+	if listId != 0 {
+		list = listId
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO feed_items (type, actor, owner, list_id, friend, count, created_at, updated_at) VALUES (?, ?, ?, ?, ?, 1, ?, ?)",
+		eventType, actor, owner, list, friend, now, now)
+	return err
+}
+
+func addGift(ctx context.Context, db *sql.DB, e event.Event) error {
+	now := time.Now().UTC()
+	res, err := db.ExecContext(ctx, "UPDATE feed_items SET count = count + 1, updated_at = ? WHERE type = ? AND actor = ? AND list_id = ? AND updated_at >= ? ORDER BY id DESC LIMIT 1",
+		now, e.Type, e.Owner, e.ListID, now.Add(-groupWindow))
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected > 0 {
+		return err
+	}
+	return insert(ctx, db, e.Type, e.Owner, e.Owner, e.ListID, "")
+}
+
+func message(item Item) string {
+	switch item.Type {
+	case event.ListCreated:
+		return fmt.Sprintf("%s created %s", item.ActorName, item.ListName)
+	case event.GiftCreated:
+		if item.Count == 1 {
+			return fmt.Sprintf("%s added a gift to %s", item.ActorName, item.ListName)
+		}
+		return fmt.Sprintf("%s added %d gifts to %s", item.ActorName, item.Count, item.ListName)
+	case event.FriendAccepted:
+		return fmt.Sprintf("%s is now friends with %s", item.ActorName, item.FriendName)
+	}
+	return item.Type
+}
+
+// GetFeed returns recent activity by the user's friends, newest first, a page
+// at a time.
+func GetFeed(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	items := []Item{}
+
+	friends, err := util.GetFriends(ctx, db, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	friends, err = util.WithProfiles(ctx, db, friends)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if len(friends) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+		return
+	}
+
+	// Items about lists that have since been archived or deleted, or that aren't shared with the user, are hidden, as are
+	// new friendships with blocked users
+	query := "SELECT feed_items.id, feed_items.type, feed_items.actor, COALESCE(feed_items.list_id, 0), COALESCE(lists.name, ''), feed_items.friend, feed_items.count, feed_items.updated_at FROM feed_items LEFT JOIN lists ON lists.id = feed_items.list_id WHERE feed_items.owner IN (?" + strings.Repeat(", ?", len(friends)-1) + ") AND feed_items.friend <> ? AND (feed_items.list_id IS NULL OR (lists.archived_at IS NULL AND lists.deleted_at IS NULL AND " + util.ListVisibleTo + "))" +
+		" AND NOT EXISTS (SELECT 1 FROM blocks WHERE (blocks.owner = ? AND blocks.blocked = feed_items.friend) OR (blocks.owner = feed_items.friend AND blocks.blocked = ?))"
+	args := make([]interface{}, 0, len(friends)+8)
+	for _, friend := range friends {
+		args = append(args, friend)
+	}
+	args = append(args, user.UID, user.UID, user.UID, user.UID, user.UID, user.UID)
+	if page.Cursor != 0 {
+		query += " AND feed_items.id < ?"
+		args = append(args, page.Cursor)
+	}
+	query += " ORDER BY feed_items.id DESC LIMIT ?"
+	args = append(args, page.Limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item Item
+		err := rows.Scan(&item.ID, &item.Type, &item.Actor, &item.ListID, &item.ListName, &item.Friend, &item.Count, &item.Time)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		items = append(items, item)
+	}
+
+	names := map[string]*auth.UserRecord{}
+	lookup := func(uid string) (*auth.UserRecord, error) {
+		if record, ok := names[uid]; ok {
+			return record, nil
+		}
+		record, err := profile.Lookup(ctx, db, uid)
+		if err != nil {
+			return nil, err
+		}
+		names[uid] = record
+		return record, nil
+	}
+	for i := range items {
+		item := &items[i]
+		actor, err := lookup(item.Actor)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		item.ActorName = actor.DisplayName
+		item.ActorPhoto = actor.PhotoURL
+		if len(item.Friend) > 0 {
+			friend, err := lookup(item.Friend)
+			if err != nil {
+				util.EncodeError(w, err)
+				return
+			}
+			item.FriendName = friend.DisplayName
+		}
+		item.Message = message(*item)
+	}
+
+	if len(items) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(items), items[len(items)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
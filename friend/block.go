@@ -0,0 +1,195 @@
+package friend
+
+import (
+	"github.com/mrbbot/gift-list-api/audit"
+	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"github.com/mrbbot/gift-list-api/event"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"firebase.google.com/go/auth"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+const (
+	// A rejected user can't send another request to the same person for this
+	// long
+	rejectionCooldown = 30 * 24 * time.Hour
+	// Friends a user can add in a day, whether or not the emails are registered
+	maxRequestsPerDay = 20
+)
+
+type Block struct {
+	ID      int64     `json:"id"`
+	Blocked string    `json:"blocked"`
+	Name    string    `json:"name,omitempty"`
+	Photo   string    `json:"photo,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// canRequest reports whether owner is allowed to send friend a request: they
+// mustn't be blocked, or have been rejected recently.
+func canRequest(ctx context.Context, q util.Querier, owner string, friend string) (bool, error) {
+	blocked, err := util.IsBlocked(ctx, q, owner, friend)
+	if err != nil || blocked {
+		return false, err
+	}
+
+	var rejections int
+	err = q.QueryRowContext(ctx, "SELECT COUNT(*) FROM friend_rejections WHERE requester = ? AND addressee = ? AND rejected_at >= ?",
+		owner, friend, time.Now().UTC().Add(-rejectionCooldown)).Scan(&rejections)
+	return rejections == 0, err
+}
+
+// checkDailyLimit writes an error response and returns false if owner has
+// added too many friends today, and otherwise counts this request towards the
+// limit. Every request counts, whatever happens to it, so the limit can't be
+// used to tell registered emails apart, or reset by cancelling requests.
+func checkDailyLimit(ctx context.Context, w http.ResponseWriter, db *sql.DB, owner string) bool {
+	now := time.Now().UTC()
+	var requests int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM friend_request_attempts WHERE requester = ? AND attempted_at >= ?", owner, now.Add(-24*time.Hour)).Scan(&requests)
+	if err != nil {
+		util.EncodeError(w, err)
+		return false
+	}
+	if requests >= maxRequestsPerDay {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "too many friend requests today"})
+		return false
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO friend_request_attempts (requester, attempted_at) VALUES (?, ?)", owner, now)
+	if err != nil {
+		util.EncodeError(w, err)
+		return false
+	}
+	return true
+}
+
+func GetBlocks(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	blocks := []Block{}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, blocked, created_at FROM blocks WHERE owner = ? AND id > ? ORDER BY id LIMIT ?", user.UID, page.Cursor, page.Limit)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var block Block
+		err := rows.Scan(&block.ID, &block.Blocked, &block.Created)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+
+		blockedUser, err := authHelper.UserFromUID(ctx, block.Blocked)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		block.Name = blockedUser.DisplayName
+		block.Photo = blockedUser.PhotoURL
+
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(blocks), blocks[len(blocks)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// BlockUser stops another user from sending friend requests or redeeming
+// invites, and removes any friendship or request between them. The blocked
+// user isn't told.
+func BlockUser(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	blocked := params["userId"]
+
+	if blocked == user.UID {
+		util.EncodeBadRequest(w, "can't block yourself")
+		return
+	}
+	_, err := authHelper.UserFromUID(ctx, blocked)
+	if err != nil {
+		util.EncodeNotFound(w)
+		return
+	}
+
+	block := Block{Blocked: blocked, Created: time.Now().UTC()}
+	var friendship Friend
+	err = util.Transact(ctx, db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT IGNORE INTO blocks (owner, blocked, created_at) VALUES (?, ?, ?)", user.UID, blocked, block.Created)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, "SELECT id, created_at FROM blocks WHERE owner = ? AND blocked = ?", user.UID, blocked).Scan(&block.ID, &block.Created)
+		if err != nil {
+			return err
+		}
+
+		// Requests go too, but only a friendship is worth telling anyone about
+		friendship, err = getFriendshipBetween(ctx, tx, user.UID, blocked)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE friendships SET deleted_at = ?, deleted_by = ? WHERE id = ?", block.Created, user.UID, friendship.ID)
+		return err
+	})
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if friendship.State {
+		audit.Record(db, r, user.UID, event.FriendRemoved, audit.EntityFriend, friendship.ID, blocked, snapshot(friendship), nil)
+		// Without a target only the user's own clients hear about it
+		publish(event.FriendRemoved, user.UID, "", friendship)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(block)
+}
+
+func UnblockUser(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	blocked := params["userId"]
+
+	res, err := db.ExecContext(ctx, "DELETE FROM blocks WHERE owner = ? AND blocked = ?", user.UID, blocked)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "block not found"})
+	}
+}
@@ -1,14 +1,23 @@
 package friend
 
 import (
+	"github.com/mrbbot/gift-list-api/audit"
 	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"github.com/mrbbot/gift-list-api/circle"
+	"github.com/mrbbot/gift-list-api/event"
+	"github.com/mrbbot/gift-list-api/profile"
 	"github.com/mrbbot/gift-list-api/util"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"firebase.google.com/go/auth"
 	"github.com/gorilla/mux"
+	"log"
 	"net/http"
-	"strconv"
+	"net/mail"
+	"strings"
+	"time"
 )
 
 type Friend struct {
@@ -19,187 +28,416 @@ type Friend struct {
 	Name   string `json:"name,omitempty"`
 	Photo  string `json:"photo,omitempty"`
 	State  bool   `json:"state"`
+	// When the request was sent, and when it was accepted if it has been
+	Requested time.Time  `json:"requested"`
+	Accepted  *time.Time `json:"accepted,omitempty"`
+	// Profiles the friend manages, who can be seen like friends of their own
+	Profiles []profile.Profile `json:"profiles,omitempty"`
 }
 
+var errAddingSelf = errors.New("can't add yourself as a friend")
+
 type emailContainer struct {
 	Email string `json:"email"`
 }
 
+// Incoming and outgoing requests are paged separately from current friends,
+// and the cursors for their next pages are in these headers.
+const (
+	NextIncomingCursorHeader = "X-Next-Incoming-Cursor"
+	NextOutgoingCursorHeader = "X-Next-Outgoing-Cursor"
+)
+
+// DefaultRequestExpiry is how long friend requests are left unanswered before
+// they're removed.
+const DefaultRequestExpiry = 30 * 24 * time.Hour
+
+var requestExpiry = DefaultRequestExpiry
+
 type friendContainer struct {
 	Current  []Friend `json:"current"`
-	Requests []Friend `json:"requests"`
+	Incoming []Friend `json:"incoming"`
+	Outgoing []Friend `json:"outgoing"`
 }
 
-func GetFriends(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
-	var container friendContainer
+// snapshot returns just the stored fields of a friendship, without the other
+// user's profile. Until a request is accepted the email it was sent to stands
+// in for the user it went to, as that's all the requester should know.
+func snapshot(friend Friend) Friend {
+	s := Friend{ID: friend.ID, Owner: friend.Owner, Friend: friend.Friend, State: friend.State, Requested: friend.Requested, Accepted: friend.Accepted}
+	if !friend.State {
+		s.Friend = ""
+		s.Email = friend.Email
+	}
+	return s
+}
+
+// friendColumns are scanned into a Friend by scanFriend, with the requester as
+// the owner. Requests sent to an email nobody has signed up with yet have no
+// addressee.
+const friendColumns = "id, requester, IFNULL(addressee, ''), IFNULL(email, ''), status = 'accepted', requested_at, accepted_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFriend scans friendColumns, followed by any extra columns.
+func scanFriend(row scanner, friend *Friend, extra ...interface{}) error {
+	dest := []interface{}{&friend.ID, &friend.Owner, &friend.Friend, &friend.Email, &friend.State, &friend.Requested, &friend.Accepted}
+	return row.Scan(append(dest, extra...)...)
+}
 
-	container.Current = []Friend{}
-	currentRows, err := db.Query("SELECT id, friend, state FROM friends WHERE owner = ?", user.UID)
+func getFriendship(ctx context.Context, q util.Querier, id interface{}) (Friend, error) {
+	var friend Friend
+	err := scanFriend(q.QueryRowContext(ctx, "SELECT "+friendColumns+" FROM friendships WHERE id = ? AND deleted_at IS NULL", id), &friend)
+	return friend, err
+}
+
+// getFriendshipBetween returns the current friendship or request between two
+// users, whichever of them sent it. It's locked until the end of the
+// transaction if q is one.
+func getFriendshipBetween(ctx context.Context, q util.Querier, a string, b string) (Friend, error) {
+	var friend Friend
+	err := scanFriend(q.QueryRowContext(ctx, "SELECT "+friendColumns+" FROM friendships WHERE "+util.FriendshipBetween+" AND deleted_at IS NULL FOR UPDATE", a, b, a, b), &friend)
+	return friend, err
+}
+
+// acceptRequest accepts a pending request sent to addressee at the given time,
+// reporting false if there wasn't one.
+func acceptRequest(ctx context.Context, q util.Querier, id int64, addressee string, at time.Time) (bool, error) {
+	res, err := q.ExecContext(ctx, "UPDATE friendships SET status = 'accepted', accepted_at = ? WHERE id = ? AND addressee = ? AND status = 'pending' AND deleted_at IS NULL",
+		at, id, addressee)
 	if err != nil {
-		util.EncodeError(w, err)
-		return
+		return false, err
 	}
-	defer currentRows.Close()
-	for currentRows.Next() {
-		var friend Friend
-		err := currentRows.Scan(&friend.ID, &friend.Friend, &friend.State)
-		if err != nil {
-			util.EncodeError(w, err)
-			return
-		}
+	rowsAffected, err := res.RowsAffected()
+	return rowsAffected > 0, err
+}
 
-		user, err := authHelper.UserFromUID(friend.Friend)
+// insertRequest sends a friend request to the user with the given email, or to
+// the email alone if addressee is empty. The unique constraint on each pair of
+// users makes it fail with a duplicate error if there's already a friendship
+// or request between them.
+func insertRequest(ctx context.Context, q util.Querier, requester string, addressee string, email string, suppressed bool) (Friend, error) {
+	friend := Friend{Owner: requester, Friend: addressee, Email: email, State: false, Requested: time.Now().UTC()}
+	var addresseeValue interface{}
+	if len(addressee) > 0 {
+		addresseeValue = addressee
+	}
+	res, err := q.ExecContext(ctx, "INSERT INTO friendships (requester, addressee, email, suppressed, status, requested_at) VALUES (?, ?, ?, ?, 'pending', ?)",
+		requester, addresseeValue, email, suppressed, friend.Requested)
+	if err != nil {
+		return friend, err
+	}
+	friend.ID, err = res.LastInsertId()
+	return friend, err
+}
+
+func publish(eventType string, actor string, target string, friend Friend) {
+	event.Publish(event.Event{Type: eventType, Actor: actor, Target: target, Data: snapshot(friend)})
+}
+
+func GetFriends(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	// Pick up requests sent to the user's email before they signed up, or
+	// verified it, without waiting for Init
+	email, _ := user.Claims["email"].(string)
+	if len(email) > 0 && user.Claims["email_verified"] == true {
+		err := resolveEmailRequests(ctx, db, user.UID, email)
 		if err != nil {
 			util.EncodeError(w, err)
 			return
 		}
-		friend.Email = user.Email
-		friend.Name = user.DisplayName
-		friend.Photo = user.PhotoURL
-
-		container.Current = append(container.Current, friend)
 	}
 
-	container.Requests = []Friend{}
-	requestRows, err := db.Query("SELECT id, owner, state FROM friends WHERE friend = ? AND state = 0", user.UID)
+	currentPage, err := util.ParsePage(r)
 	if err != nil {
-		util.EncodeError(w, err)
+		util.EncodeBadRequest(w, err.Error())
 		return
 	}
-	defer requestRows.Close()
-	for requestRows.Next() {
-		var friend Friend
-		err := requestRows.Scan(&friend.ID, &friend.Owner, &friend.State)
+	incomingPage, err := util.ParsePageWith(r, "incomingCursor")
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+	outgoingPage, err := util.ParsePageWith(r, "outgoingCursor")
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	currentQuery := "SELECT " + friendColumns + " FROM friendships WHERE (requester = ? OR addressee = ?) AND status = 'accepted' AND deleted_at IS NULL AND id > ?"
+	currentArgs := []interface{}{user.UID, user.UID, currentPage.Cursor}
+	if circleId := r.URL.Query().Get("circle"); len(circleId) > 0 {
+		owns, err := circle.Owns(ctx, db, user.UID, circleId)
 		if err != nil {
 			util.EncodeError(w, err)
 			return
 		}
-
-		user, err := authHelper.UserFromUID(friend.Owner)
-		if err != nil {
-			util.EncodeError(w, err)
+		if !owns {
+			util.EncodeNotFound(w)
 			return
 		}
-		friend.Email = user.Email
-		friend.Name = user.DisplayName
-		friend.Photo = user.PhotoURL
-
-		container.Requests = append(container.Requests, friend)
+		currentQuery += " AND IF(requester = ?, addressee, requester) IN (SELECT member FROM circle_members WHERE circle_id = ?)"
+		currentArgs = append(currentArgs, user.UID, circleId)
 	}
+	currentQuery += " ORDER BY id LIMIT ?"
+	currentArgs = append(currentArgs, currentPage.Limit)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(container)
-}
-
-func AddFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
-	var email emailContainer
-	json.NewDecoder(r.Body).Decode(&email)
+	var container friendContainer
 
-	friendUser, err := authHelper.UserFromEmail(email.Email)
+	container.Current, err = listFriendships(ctx, db, user.UID, currentQuery, currentArgs...)
 	if err != nil {
-		util.EncodeNotFound(w)
+		util.EncodeError(w, err)
 		return
 	}
-
-	friend := Friend{Owner: user.UID, Friend: friendUser.UID, State: false}
-	if user.UID == friendUser.UID {
-		util.EncodeUnauthorised(w)
-		return
+	for i := range container.Current {
+		friend := &container.Current[i]
+		// Current friends are shown from the user's side
+		if friend.Friend == user.UID {
+			friend.Friend = friend.Owner
+		}
+		friend.Owner = ""
+		friend.Profiles, err = profile.GetManaged(ctx, db, friend.Friend)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
 	}
 
-	// Check if the users are already friends
-	existingFriend, err := db.Query("SELECT id FROM friends WHERE owner = ? AND friend = ?", user.UID, friendUser.UID)
+	container.Incoming, err = listFriendships(ctx, db, user.UID, "SELECT "+friendColumns+" FROM friendships WHERE addressee = ? AND status = 'pending' AND deleted_at IS NULL AND id > ? ORDER BY id LIMIT ?", user.UID, incomingPage.Cursor, incomingPage.Limit)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	defer existingFriend.Close()
-	if existingFriend.Next() {
-		util.EncodeUnauthorised(w)
-		return
-	}
-
-	// Check if there is a pending friend request the other way
-	existingFriendRequest, err := db.Query("SELECT id, owner, friend FROM friends WHERE owner = ? AND friend = ? AND state = 0", friendUser.UID, user.UID)
+	container.Outgoing, err = listOutgoing(ctx, db, user.UID, outgoingPage)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	defer existingFriendRequest.Close()
-	if existingFriendRequest.Next() {
-		var (
-			friendId  int64
-			ownerUid  string
-			friendUid string
-		)
-		existingFriendRequest.Scan(&friendId, &ownerUid, &friendUid)
-		doAcceptFriend(db, strconv.FormatInt(friendId, 10), ownerUid, friendUid)
 
-		w.Header().Set("Content-Type", "application/json")
-		friend.ID = friendId
+	if len(container.Current) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, currentPage, len(container.Current), container.Current[len(container.Current)-1].ID)
+	}
+	if len(container.Incoming) > 0 {
+		util.WriteNextCursor(w, NextIncomingCursorHeader, incomingPage, len(container.Incoming), container.Incoming[len(container.Incoming)-1].ID)
+	}
+	if len(container.Outgoing) > 0 {
+		util.WriteNextCursor(w, NextOutgoingCursorHeader, outgoingPage, len(container.Outgoing), container.Outgoing[len(container.Outgoing)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(container)
+}
 
-		//TODO: may be owner
-		user, err := authHelper.UserFromUID(friend.Friend)
+// listFriendships returns the friendships selected by query, which must select
+// friendColumns, with the profile of the user on the other side from uid.
+func listFriendships(ctx context.Context, db *sql.DB, uid string, query string, args ...interface{}) ([]Friend, error) {
+	friends := []Friend{}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var friend Friend
+		err := scanFriend(rows, &friend)
 		if err != nil {
-			util.EncodeError(w, err)
-			return
+			return nil, err
+		}
+		friends = append(friends, friend)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range friends {
+		friend := &friends[i]
+		other := friend.Friend
+		if other == uid {
+			other = friend.Owner
+		}
+		user, err := authHelper.UserFromUID(ctx, other)
+		if err != nil {
+			return nil, err
 		}
 		friend.Email = user.Email
 		friend.Name = user.DisplayName
 		friend.Photo = user.PhotoURL
+	}
+	return friends, nil
+}
 
-		friend.State = true
-		json.NewEncoder(w).Encode(friend)
+// listOutgoing returns a page of the requests uid has sent. They only show the
+// email each was sent to, so requests to users look the same as ones waiting
+// for someone to sign up.
+func listOutgoing(ctx context.Context, db *sql.DB, uid string, page util.Page) ([]Friend, error) {
+	requests := []Friend{}
+	rows, err := db.QueryContext(ctx, "SELECT "+friendColumns+" FROM friendships WHERE requester = ? AND status = 'pending' AND deleted_at IS NULL AND id > ? ORDER BY id LIMIT ?", uid, page.Cursor, page.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var request Friend
+		err := scanFriend(rows, &request)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range requests {
+		request := &requests[i]
+		// Requests sent before emails were stored only have the addressee
+		if len(request.Email) == 0 && len(request.Friend) > 0 {
+			addressee, err := authHelper.UserFromUID(ctx, request.Friend)
+			if err != nil {
+				return nil, err
+			}
+			request.Email = addressee.Email
+		}
+		request.Friend = ""
+	}
+	return requests, nil
+}
 
+// AddFriend sends a friend request to the user with the given email, or to the
+// email alone if nobody has signed up with it yet, in which case it goes to
+// whoever does. If they've already asked to be friends, their request is
+// accepted instead. The response and the outgoing request are the same
+// whatever happens, so they can't be used to find out who's registered.
+func AddFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	var email emailContainer
+	json.NewDecoder(r.Body).Decode(&email)
+	if _, err := mail.ParseAddress(email.Email); err != nil {
+		util.EncodeBadRequest(w, "invalid email")
 		return
 	}
-
-	res, err := db.Exec("INSERT INTO friends (owner, friend, state) VALUES (?, ?, ?)", friend.Owner, friend.Friend, friend.State)
-	if err != nil {
-		util.EncodeError(w, err)
+	if !checkDailyLimit(ctx, w, db, user.UID) {
 		return
 	}
 
-	friend.ID, err = res.LastInsertId()
-	if err != nil {
-		util.EncodeError(w, err)
+	err := addFriend(ctx, db, r, user.UID, email.Email)
+	if err == errAddingSelf {
+		util.EncodeBadRequest(w, err.Error())
 		return
 	}
-
-	userRecord, err := authHelper.UserFromUID(friend.Friend)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	friend.Email = userRecord.Email
-	friend.Name = userRecord.DisplayName
-	friend.Photo = userRecord.PhotoURL
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(friend)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(util.Response{Success: true, Message: "friend request sent"})
 }
 
-func doAcceptFriend(db *sql.DB, friendId string, owner string, friend string) error {
-	_, err := db.Exec("UPDATE friends SET state = ? WHERE id = ?", true, friendId)
-	if err != nil {
+// addFriend does the work of AddFriend. Requests that can't be sent, because
+// of a block or a recent rejection, are stored but never passed on, and ones
+// an existing friendship or request already covers are dropped, all without
+// an error.
+func addFriend(ctx context.Context, db *sql.DB, r *http.Request, owner string, email string) error {
+	email = strings.ToLower(email)
+	friendUser, err := authHelper.UserFromEmail(ctx, email)
+	if err != nil && !auth.IsUserNotFound(err) {
 		return err
 	}
+	if err == nil && friendUser.UID == owner {
+		return errAddingSelf
+	}
+	// Requests to an email nobody has verified wait until someone does, so
+	// signing up with someone else's email doesn't get their requests
+	if err != nil || !friendUser.EmailVerified {
+		friend, created, err := requestByEmail(ctx, db, owner, email, false)
+		if err != nil || !created {
+			return err
+		}
+		audit.Record(db, r, owner, event.FriendRequested, audit.EntityFriend, friend.ID, owner, nil, snapshot(friend))
+		return nil
+	}
 
-	_, err = db.Exec("INSERT INTO friends (owner, friend, state) VALUES (?, ?, ?)", friend, owner, true)
+	// The request between them is locked until this decides what to do with it,
+	// so a crossed request can't be inserted in the meantime
+	var (
+		friend   Friend
+		request  Friend
+		accepted bool
+	)
+	err = util.Transact(ctx, db, func(tx *sql.Tx) error {
+		existing, err := getFriendshipBetween(ctx, tx, owner, friendUser.UID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			// Already friends, or already asked
+			if existing.State || existing.Owner == owner {
+				return nil
+			}
+
+			// Accept their pending request instead of sending one back
+			now := time.Now().UTC()
+			accepted, err = acceptRequest(ctx, tx, existing.ID, owner, now)
+			if err != nil || !accepted {
+				return err
+			}
+			request = existing
+			friend = existing
+			friend.State = true
+			friend.Accepted = &now
+			return nil
+		}
+
+		allowed, err := canRequest(ctx, tx, owner, friendUser.UID)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			// Kept as a request to the email that's never passed on, so the
+			// requester sees exactly what they would if nobody had signed up
+			// with it
+			friend, _, err = requestByEmail(ctx, tx, owner, email, true)
+			return err
+		}
+		friend, err = insertRequest(ctx, tx, owner, friendUser.UID, email, false)
+		if util.IsDuplicate(err) {
+			// Someone got there first
+			return nil
+		}
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	if accepted {
+		audit.Record(db, r, owner, event.FriendAccepted, audit.EntityFriend, friend.ID, friend.Owner, snapshot(request), snapshot(friend))
+		publish(event.FriendAccepted, owner, friend.Owner, friend)
+		return nil
+	}
+	if friend.ID == 0 {
+		return nil
+	}
 
+	// Recorded against the requester, exactly as a request to an unregistered
+	// email is
+	audit.Record(db, r, owner, event.FriendRequested, audit.EntityFriend, friend.ID, owner, nil, snapshot(friend))
+	if len(friend.Friend) > 0 {
+		publish(event.FriendRequested, owner, friend.Friend, friend)
+	}
 	return nil
 }
 
 func AcceptFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	friendId := params["friendId"]
 
-	var currentFriend Friend
-	err := db.QueryRow("SELECT * FROM friends WHERE id = ?", friendId).Scan(
-		&currentFriend.ID, &currentFriend.Owner, &currentFriend.Friend, &currentFriend.State)
+	currentFriend, err := getFriendship(ctx, db, friendId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -210,24 +448,33 @@ func AcceptFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth
 		return
 	}
 
-	currentFriend.State = true
-	err = doAcceptFriend(db, friendId, currentFriend.Owner, currentFriend.Friend)
+	now := time.Now().UTC()
+	accepted, err := acceptRequest(ctx, db, currentFriend.ID, user.UID, now)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
+	if !accepted {
+		util.EncodeUnauthorised(w)
+		return
+	}
+	request := snapshot(currentFriend)
+	currentFriend.State = true
+	currentFriend.Accepted = &now
+
+	audit.Record(db, r, user.UID, event.FriendAccepted, audit.EntityFriend, currentFriend.ID, currentFriend.Owner, request, snapshot(currentFriend))
+	publish(event.FriendAccepted, user.UID, currentFriend.Owner, currentFriend)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(currentFriend)
 }
 
 func RejectFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	friendId := params["friendId"]
 
-	var currentFriend Friend
-	err := db.QueryRow("SELECT * FROM friends WHERE id = ?", friendId).Scan(
-		&currentFriend.ID, &currentFriend.Owner, &currentFriend.Friend, &currentFriend.State)
+	currentFriend, err := getFriendship(ctx, db, friendId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -238,7 +485,57 @@ func RejectFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth
 		return
 	}
 
-	res, err := db.Exec("DELETE FROM friends WHERE id = ?", friendId)
+	var rowsAffected int64
+	err = util.Transact(ctx, db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM friendships WHERE id = ? AND status = 'pending'", currentFriend.ID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err = res.RowsAffected()
+		if err != nil || rowsAffected == 0 {
+			return err
+		}
+
+		// Remembered so the same request can't be sent again straight away
+		_, err = tx.ExecContext(ctx, "INSERT INTO friend_rejections (requester, addressee, rejected_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE rejected_at = VALUES(rejected_at)",
+			currentFriend.Owner, user.UID, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		audit.Record(db, r, user.UID, event.FriendRejected, audit.EntityFriend, currentFriend.ID, currentFriend.Owner, snapshot(currentFriend), nil)
+		publish(event.FriendRejected, user.UID, currentFriend.Owner, currentFriend)
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "friend not found"})
+	}
+}
+
+// CancelFriend withdraws a request the user has sent that hasn't been answered
+// yet.
+func CancelFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	friendId := params["friendId"]
+
+	currentFriend, err := getFriendship(ctx, db, friendId)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	if (currentFriend.Owner != user.UID) || (currentFriend.State) {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "DELETE FROM friendships WHERE id = ? AND status = 'pending'", currentFriend.ID)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -251,6 +548,8 @@ func RejectFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth
 
 	w.Header().Set("Content-Type", "application/json")
 	if rowsAffected > 0 {
+		audit.Record(db, r, user.UID, event.FriendCancelled, audit.EntityFriend, currentFriend.ID, user.UID, snapshot(currentFriend), nil)
+		publish(event.FriendCancelled, user.UID, currentFriend.Friend, currentFriend)
 		json.NewEncoder(w).Encode(util.Response{Success: true})
 	} else {
 		w.WriteHeader(http.StatusNotFound)
@@ -258,13 +557,33 @@ func RejectFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth
 	}
 }
 
+// expireRequests removes requests that have gone unanswered for longer than
+// requestExpiry. They're deleted outright like rejected and cancelled ones, as
+// there's nothing to restore.
+func expireRequests(ctx context.Context, db *sql.DB) error {
+	if requestExpiry <= 0 {
+		return nil
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM friendships WHERE status = 'pending' AND requested_at < ? AND deleted_at IS NULL", time.Now().UTC().Add(-requestExpiry))
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected > 0 {
+		log.Printf("expired %d friend requests\n", rowsAffected)
+	}
+	return nil
+}
+
 func RemoveFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	id := params["friendId"]
 
-	var currentFriend Friend
-	err := db.QueryRow("SELECT * FROM friends WHERE id = ?", id).Scan(
-		&currentFriend.ID, &currentFriend.Owner, &currentFriend.Friend, &currentFriend.State)
+	currentFriend, err := getFriendship(ctx, db, id)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -275,7 +594,8 @@ func RemoveFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth
 		return
 	}
 
-	res, err := db.Exec("DELETE FROM friends WHERE (owner = ? AND friend = ?) OR (owner = ? AND friend = ?)", currentFriend.Owner, currentFriend.Friend, currentFriend.Friend, currentFriend.Owner)
+	// Only marked as deleted so it can be restored, and purged later
+	res, err := db.ExecContext(ctx, "UPDATE friendships SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL", time.Now().UTC(), user.UID, currentFriend.ID)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -288,9 +608,74 @@ func RemoveFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth
 
 	w.Header().Set("Content-Type", "application/json")
 	if rowsAffected > 0 {
+		other := currentFriend.Friend
+		if other == user.UID {
+			other = currentFriend.Owner
+		}
+		audit.Record(db, r, user.UID, event.FriendRemoved, audit.EntityFriend, currentFriend.ID, other, snapshot(currentFriend), nil)
+		publish(event.FriendRemoved, user.UID, other, currentFriend)
 		json.NewEncoder(w).Encode(util.Response{Success: true})
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "friend not found"})
 	}
 }
+
+func UndoRemoveFriend(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["friendId"]
+
+	var (
+		currentFriend Friend
+		deletedAt     time.Time
+		deletedBy     string
+	)
+	err := scanFriend(db.QueryRowContext(ctx, "SELECT "+friendColumns+", deleted_at, deleted_by FROM friendships WHERE id = ? AND deleted_at >= ?", id, time.Now().UTC().Add(-util.UndoWindow)),
+		&currentFriend, &deletedAt, &deletedBy)
+	if err == sql.ErrNoRows {
+		util.EncodeNotFound(w)
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	// Only the user who removed the friendship can bring it back
+	if deletedBy != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	blocked, err := util.IsBlocked(ctx, db, currentFriend.Owner, currentFriend.Friend)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if blocked {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE friendships SET deleted_at = NULL, deleted_by = '' WHERE id = ? AND deleted_at = ?", currentFriend.ID, deletedAt)
+	if util.IsDuplicate(err) {
+		// Don't restore over a friendship or request that has been made since
+		util.EncodeUnauthorised(w)
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	other := currentFriend.Friend
+	if other == user.UID {
+		other = currentFriend.Owner
+	}
+	audit.Record(db, r, user.UID, event.FriendRestored, audit.EntityFriend, currentFriend.ID, other, nil, snapshot(currentFriend))
+	publish(event.FriendRestored, user.UID, other, currentFriend)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentFriend)
+}
@@ -0,0 +1,439 @@
+package friend
+
+import (
+	"github.com/mrbbot/gift-list-api/audit"
+	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"github.com/mrbbot/gift-list-api/event"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"firebase.google.com/go/auth"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInviteLifetime = 7 * 24 * time.Hour
+	maxInviteLifetime     = 30 * 24 * time.Hour
+	maxInviteUses         = 100
+
+	resolveInterval = 5 * time.Minute
+)
+
+var errAlreadyFriends = errors.New("already friends")
+
+// Invite lets whoever has the token become friends with the owner without
+// knowing their email.
+type Invite struct {
+	ID      int64     `json:"id"`
+	Token   string    `json:"token"`
+	MaxUses int       `json:"maxUses"`
+	Uses    int       `json:"uses"`
+	Expires time.Time `json:"expires"`
+	Created time.Time `json:"created"`
+}
+
+type inviteOptions struct {
+	MaxUses int        `json:"maxUses"`
+	Expires *time.Time `json:"expires"`
+}
+
+// Init starts passing requests sent to an email on to whoever signs up with it,
+// and removing requests that have gone unanswered for longer than expiry.
+// Requests never expire if expiry is 0.
+func Init(db *sql.DB, expiry time.Duration) {
+	ctx := context.Background()
+	requestExpiry = expiry
+	go func() {
+		for {
+			err := resolvePendingRequests(ctx, db)
+			if err != nil {
+				log.Printf("error resolving email requests: %v\n", err)
+			}
+			err = expireRequests(ctx, db)
+			if err != nil {
+				log.Printf("error expiring friend requests: %v\n", err)
+			}
+			time.Sleep(resolveInterval)
+		}
+	}()
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func insertInvite(ctx context.Context, db *sql.DB, owner string, invite *Invite) error {
+	res, err := db.ExecContext(ctx, "INSERT INTO invites (owner, token, max_uses, uses, expires_at, created_at) VALUES (?, ?, ?, 0, ?, ?)",
+		owner, invite.Token, invite.MaxUses, invite.Expires, invite.Created)
+	if err != nil {
+		return err
+	}
+	invite.ID, err = res.LastInsertId()
+	return err
+}
+
+// befriend makes a and b friends, accepting a pending request between them if
+// there is one, and returns the ID of the friendship.
+func befriend(ctx context.Context, db *sql.DB, a string, b string) (int64, error) {
+	var id int64
+	err := util.Transact(ctx, db, func(tx *sql.Tx) error {
+		existing, err := getFriendshipBetween(ctx, tx, a, b)
+		switch {
+		case err == sql.ErrNoRows:
+			now := time.Now().UTC()
+			res, err := tx.ExecContext(ctx, "INSERT INTO friendships (requester, addressee, status, requested_at, accepted_at) VALUES (?, ?, 'accepted', ?, ?)", a, b, now, now)
+			if util.IsDuplicate(err) {
+				return errAlreadyFriends
+			}
+			if err != nil {
+				return err
+			}
+			id, err = res.LastInsertId()
+			return err
+		case err != nil:
+			return err
+		case existing.State:
+			return errAlreadyFriends
+		default:
+			id = existing.ID
+			_, err = acceptRequest(ctx, tx, existing.ID, existing.Friend, time.Now().UTC())
+			return err
+		}
+	})
+	return id, err
+}
+
+func GetInvites(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	invites := []Invite{}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, token, max_uses, uses, expires_at, created_at FROM invites WHERE owner = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses AND id > ? ORDER BY id LIMIT ?",
+		user.UID, time.Now().UTC(), page.Cursor, page.Limit)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var invite Invite
+		err := rows.Scan(&invite.ID, &invite.Token, &invite.MaxUses, &invite.Uses, &invite.Expires, &invite.Created)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		invites = append(invites, invite)
+	}
+
+	if len(invites) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(invites), invites[len(invites)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+func CreateInvite(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	var options inviteOptions
+	json.NewDecoder(r.Body).Decode(&options)
+
+	now := time.Now().UTC()
+	invite := Invite{MaxUses: 1, Expires: now.Add(defaultInviteLifetime), Created: now}
+	if options.MaxUses != 0 {
+		if options.MaxUses < 1 || options.MaxUses > maxInviteUses {
+			util.EncodeBadRequest(w, "maxUses must be between 1 and "+strconv.Itoa(maxInviteUses))
+			return
+		}
+		invite.MaxUses = options.MaxUses
+	}
+	if options.Expires != nil {
+		if !options.Expires.After(now) || options.Expires.After(now.Add(maxInviteLifetime)) {
+			util.EncodeBadRequest(w, "expires must be in the next 30 days")
+			return
+		}
+		invite.Expires = options.Expires.UTC()
+	}
+
+	var err error
+	invite.Token, err = generateToken()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	err = insertInvite(ctx, db, user.UID, &invite)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invite)
+}
+
+func RevokeInvite(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["inviteId"]
+
+	res, err := db.ExecContext(ctx, "UPDATE invites SET revoked_at = ? WHERE id = ? AND owner = ? AND revoked_at IS NULL", time.Now().UTC(), id, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "invite not found"})
+	}
+}
+
+func RedeemInvite(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	token := params["token"]
+
+	var (
+		inviteId int64
+		owner    string
+	)
+	now := time.Now().UTC()
+	err := db.QueryRowContext(ctx, "SELECT id, owner FROM invites WHERE token = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses", token, now).Scan(&inviteId, &owner)
+	if err == sql.ErrNoRows {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "invite not found"})
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	if owner == user.UID {
+		util.EncodeBadRequest(w, "can't redeem your own invite")
+		return
+	}
+	// Blocked users are told the invite doesn't exist
+	blocked, err := util.IsBlocked(ctx, db, user.UID, owner)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if blocked {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "invite not found"})
+		return
+	}
+	areFriends, err := util.AreFriends(ctx, db, user.UID, owner)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if areFriends {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	// The use is taken before befriending so two redemptions can't both get
+	// the last one
+	res, err := db.ExecContext(ctx, "UPDATE invites SET uses = uses + 1 WHERE id = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses", inviteId, now)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if rowsAffected == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "invite not found"})
+		return
+	}
+
+	friend := Friend{Owner: user.UID, Friend: owner, State: true}
+	friend.ID, err = befriend(ctx, db, user.UID, owner)
+	if err == errAlreadyFriends {
+		util.EncodeUnauthorised(w)
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	audit.Record(db, r, user.UID, event.FriendAccepted, audit.EntityFriend, friend.ID, owner, nil, snapshot(friend))
+	publish(event.FriendAccepted, user.UID, owner, friend)
+
+	ownerRecord, err := authHelper.UserFromUID(ctx, owner)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	friend.Email = ownerRecord.Email
+	friend.Name = ownerRecord.DisplayName
+	friend.Photo = ownerRecord.PhotoURL
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(friend)
+}
+
+// requestByEmail sends a request to an email nobody has signed up with yet,
+// reporting false if owner has already sent one there. Suppressed requests are
+// never passed on to anyone.
+func requestByEmail(ctx context.Context, q util.Querier, owner string, email string, suppressed bool) (Friend, bool, error) {
+	var id int64
+	err := q.QueryRowContext(ctx, "SELECT id FROM friendships WHERE requester = ? AND addressee IS NULL AND email = ? AND deleted_at IS NULL", owner, email).Scan(&id)
+	if err == nil {
+		return Friend{}, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return Friend{}, false, err
+	}
+	friend, err := insertRequest(ctx, q, owner, "", email, suppressed)
+	return friend, err == nil, err
+}
+
+// resolveEmailRequests passes requests sent to a newly signed up user's email
+// on to them. The email must have been verified, or anyone could sign up with
+// it and take the requests. Requests they can't be sent, because of a block or
+// a recent rejection, or that are already covered by a friendship or request
+// between the two, are suppressed rather than removed, so the requester can't
+// tell what happened.
+func resolveEmailRequests(ctx context.Context, db *sql.DB, uid string, email string) error {
+	rows, err := db.QueryContext(ctx, "SELECT "+friendColumns+" FROM friendships WHERE addressee IS NULL AND email = ? AND NOT suppressed AND deleted_at IS NULL", strings.ToLower(email))
+	if err != nil {
+		return err
+	}
+	var requests []Friend
+	for rows.Next() {
+		var request Friend
+		err := scanFriend(rows, &request)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		requests = append(requests, request)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, request := range requests {
+		allowed := request.Owner != uid
+		if allowed {
+			allowed, err = canRequest(ctx, db, request.Owner, uid)
+			if err != nil {
+				return err
+			}
+		}
+		if !allowed {
+			err = suppressEmailRequest(ctx, db, request.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		res, err := db.ExecContext(ctx, "UPDATE friendships SET addressee = ? WHERE id = ? AND addressee IS NULL", uid, request.ID)
+		if util.IsDuplicate(err) {
+			// There's already a friendship or request between them
+			err = suppressEmailRequest(ctx, db, request.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			continue
+		}
+
+		// Recorded when it was sent, but only now is there anyone to tell
+		request.Friend = uid
+		publish(event.FriendRequested, request.Owner, uid, request)
+	}
+	return nil
+}
+
+func suppressEmailRequest(ctx context.Context, db *sql.DB, id int64) error {
+	_, err := db.ExecContext(ctx, "UPDATE friendships SET suppressed = TRUE WHERE id = ? AND addressee IS NULL", id)
+	return err
+}
+
+func resolvePendingRequests(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT email FROM friendships WHERE addressee IS NULL AND NOT suppressed AND deleted_at IS NULL")
+	if err != nil {
+		return err
+	}
+	var emails []string
+	for rows.Next() {
+		var email string
+		err := rows.Scan(&email)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		record, err := authHelper.UserFromEmail(ctx, email)
+		if auth.IsUserNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !record.EmailVerified {
+			continue
+		}
+		err = resolveEmailRequests(ctx, db, record.UID, email)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package gift
+
+import (
+	"github.com/mrbbot/gift-list-api/audit"
+	"github.com/mrbbot/gift-list-api/event"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+type ClaimState int
+
+// Claim states are stored as their index in the claim_status column, so new
+// states must only ever be appended.
+const (
+	Unclaimed ClaimState = iota
+	Reserved
+	Purchased
+	Delivered
+)
+
+var claimStateNames = []string{"unclaimed", "reserved", "purchased", "delivered"}
+
+// claimTransitions lists the states each state may move to.
+var claimTransitions = map[ClaimState][]ClaimState{
+	Unclaimed: {Reserved},
+	Reserved:  {Unclaimed, Purchased},
+	Purchased: {Reserved, Delivered},
+	Delivered: {},
+}
+
+const expiryInterval = time.Minute
+
+func (s ClaimState) String() string {
+	if s < 0 || int(s) >= len(claimStateNames) {
+		return fmt.Sprintf("ClaimState(%d)", int(s))
+	}
+	return claimStateNames[s]
+}
+
+// CanBecome reports whether a claim may move from s to next. Staying in the
+// same state is allowed so that reservations can be extended.
+func (s ClaimState) CanBecome(next ClaimState) bool {
+	if s == next {
+		return true
+	}
+	for _, allowed := range claimTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+func (s ClaimState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *ClaimState) UnmarshalJSON(data []byte) error {
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+	for i, n := range claimStateNames {
+		if n == name {
+			*s = ClaimState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown claim state %q", name)
+}
+
+// Init starts releasing reservations once their expiry has passed.
+func Init(db *sql.DB) {
+	ctx := context.Background()
+	go func() {
+		for range time.Tick(expiryInterval) {
+			err := releaseExpired(ctx, db)
+			if err != nil {
+				log.Printf("error releasing expired reservations: %v\n", err)
+			}
+		}
+	}()
+}
+
+func releaseExpired(ctx context.Context, db *sql.DB) error {
+	now := time.Now().UTC()
+	rows, err := db.QueryContext(ctx, "SELECT gifts.id, gifts.list_id, gifts.claimed_by, lists.owner FROM lists, gifts WHERE lists.id = gifts.list_id AND gifts.claim_status = ? AND gifts.claim_expires <= ? AND gifts.deleted_at IS NULL AND lists.deleted_at IS NULL", Reserved, now)
+	if err != nil {
+		return err
+	}
+
+	type expired struct {
+		id      int64
+		listId  string
+		claimer string
+		owner   string
+	}
+	var gifts []expired
+	for rows.Next() {
+		var e expired
+		err := rows.Scan(&e.id, &e.listId, &e.claimer, &e.owner)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		gifts = append(gifts, e)
+	}
+	rows.Close()
+
+	for _, e := range gifts {
+		// Only release the reservation if it hasn't been extended or changed since
+		res, err := db.ExecContext(ctx, "UPDATE gifts SET claim_status = ?, claimed_by = '', claim_updated = ?, claim_expires = NULL WHERE id = ? AND claim_status = ? AND claim_expires <= ?",
+			Unclaimed, now, e.id, Reserved, now)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected > 0 {
+			audit.Record(db, nil, audit.System, event.GiftUnclaimed, audit.EntityGift, e.id, e.owner, Claim{State: Reserved, User: e.claimer}, Claim{State: Unclaimed, Updated: &now})
+			publish(event.GiftUnclaimed, e.claimer, e.owner, e.listId, &Gift{ID: e.id, Claim: &Claim{State: Unclaimed, Updated: &now}})
+		}
+	}
+
+	return nil
+}
@@ -1,49 +1,78 @@
 package gift
 
 import (
+	"github.com/mrbbot/gift-list-api/audit"
+	"github.com/mrbbot/gift-list-api/event"
 	"github.com/mrbbot/gift-list-api/util"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"firebase.google.com/go/auth"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Gift struct {
-	ID          int64  `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Url         string `json:"url"`
-	ImageUrl    string `json:"imageUrl"`
-	Claim       *Claim `json:"claim"`
+	ID          int64      `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Url         string     `json:"url"`
+	ImageUrl    string     `json:"imageUrl"`
+	Received    *time.Time `json:"received,omitempty"`
+	Archived    *time.Time `json:"archived,omitempty"`
+	Claim       *Claim     `json:"claim"`
 }
 
 type Claim struct {
-	State int    `json:"state"`
-	User  string `json:"user,omitempty"`
-	Name  string `json:"name,omitempty"`
-	Photo string `json:"photo,omitempty"`
+	State   ClaimState `json:"state"`
+	User    string     `json:"user,omitempty"`
+	Name    string     `json:"name,omitempty"`
+	Photo   string     `json:"photo,omitempty"`
+	Updated *time.Time `json:"updated,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func getGift(ctx context.Context, db *sql.DB, giftId string, listId string) (Gift, error) {
+	var gift Gift
+	gift.Claim = &Claim{}
+	err := db.QueryRowContext(ctx, "SELECT id, name, description, url, image_url, received_at, archived_at, claim_status, claimed_by, claim_updated, claim_expires FROM gifts WHERE id = ? AND list_id = ? AND deleted_at IS NULL", giftId, listId).Scan(
+		&gift.ID, &gift.Name, &gift.Description, &gift.Url, &gift.ImageUrl, &gift.Received, &gift.Archived, &gift.Claim.State, &gift.Claim.User, &gift.Claim.Updated, &gift.Claim.Expires)
+	return gift, err
+}
+
+// withoutClaim returns a copy of the gift that's safe to show the list owner.
+func (g Gift) withoutClaim() Gift {
+	g.Claim = nil
+	return g
+}
+
+func publish(eventType string, actor string, owner string, listId string, gift *Gift) {
+	id, _ := strconv.ParseInt(listId, 10, 64)
+	event.Publish(event.Event{Type: eventType, Actor: actor, Owner: owner, ListID: id, Data: gift})
 }
 
 func CreateGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 
 	listId := params["listId"]
-	currentOwner, err := util.GetListOwner(db, listId)
+	currentOwner, manager, err := util.GetListOwner(ctx, db, listId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	if currentOwner != user.UID {
+	if manager != user.UID {
 		util.EncodeUnauthorised(w)
 		return
 	}
 
 	var gift Gift
 	json.NewDecoder(r.Body).Decode(&gift)
-	gift.Claim = &Claim{State: 0, User: ""}
+	gift.Claim = &Claim{State: Unclaimed, User: ""}
 
-	res, err := db.Exec("INSERT INTO gifts (name, description, url, image_url, list_id, claim_status, claimed_by) VALUES (?, ?, ?, ?, ?, ?, ?)",
+	res, err := db.ExecContext(ctx, "INSERT INTO gifts (name, description, url, image_url, list_id, claim_status, claimed_by) VALUES (?, ?, ?, ?, ?, ?, ?)",
 		gift.Name, gift.Description, gift.Url, gift.ImageUrl, listId, gift.Claim.State, gift.Claim.User)
 	if err != nil {
 		util.EncodeError(w, err)
@@ -56,34 +85,36 @@ func CreateGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.T
 		return
 	}
 
+	audit.Record(db, r, user.UID, event.GiftCreated, audit.EntityGift, gift.ID, currentOwner, nil, gift.withoutClaim())
+	publish(event.GiftCreated, user.UID, currentOwner, listId, &gift)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(&gift)
 
 }
 
 func EditGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	giftId := params["giftId"]
 
 	listId := params["listId"]
-	currentOwner, err := util.GetListOwner(db, listId)
+	currentOwner, manager, err := util.GetListOwner(ctx, db, listId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	if currentOwner != user.UID {
+	if manager != user.UID {
 		util.EncodeUnauthorised(w)
 		return
 	}
 
-	var currentGift Gift
-	currentGift.Claim = &Claim{}
-	err = db.QueryRow("SELECT id, name, description, url, image_url, claim_status, claimed_by FROM gifts WHERE id = ?", giftId).Scan(
-		&currentGift.ID, &currentGift.Name, &currentGift.Description, &currentGift.Url, &currentGift.ImageUrl, &currentGift.Claim.State, &currentGift.Claim.User)
+	currentGift, err := getGift(ctx, db, giftId, listId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
+	before := currentGift
 
 	var newGift Gift
 	json.NewDecoder(r.Body).Decode(&newGift)
@@ -100,32 +131,52 @@ func EditGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Tok
 		currentGift.ImageUrl = newGift.ImageUrl
 	}
 
-	_, err = db.Exec("UPDATE gifts SET name = ?, description = ?, url = ?, image_url = ? WHERE id = ?", currentGift.Name, currentGift.Description, currentGift.Url, currentGift.ImageUrl, giftId)
+	_, err = db.ExecContext(ctx, "UPDATE gifts SET name = ?, description = ?, url = ?, image_url = ? WHERE id = ?", currentGift.Name, currentGift.Description, currentGift.Url, currentGift.ImageUrl, giftId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
 
+	// The claim is left out so that the owner, and the manager of a profile's
+	// list, never learn about it through their own events or the response
+	updated := currentGift.withoutClaim()
+	audit.Record(db, r, user.UID, event.GiftUpdated, audit.EntityGift, currentGift.ID, currentOwner, before.withoutClaim(), updated)
+	publish(event.GiftUpdated, user.UID, currentOwner, listId, &updated)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(currentGift)
+	json.NewEncoder(w).Encode(updated)
 }
 
 func RemoveGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	giftId := params["giftId"]
 
 	listId := params["listId"]
-	currentOwner, err := util.GetListOwner(db, listId)
+	currentOwner, manager, err := util.GetListOwner(ctx, db, listId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	if currentOwner != user.UID {
+	if manager != user.UID {
 		util.EncodeUnauthorised(w)
 		return
 	}
 
-	res, err := db.Exec("DELETE FROM gifts WHERE id = ?", giftId)
+	currentGift, err := getGift(ctx, db, giftId, listId)
+	if err == sql.ErrNoRows {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "gift not found"})
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	// Gifts are only marked as deleted so they can be restored, and are purged later
+	res, err := db.ExecContext(ctx, "UPDATE gifts SET deleted_at = ? WHERE id = ? AND list_id = ? AND deleted_at IS NULL", time.Now().UTC(), giftId, listId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -138,6 +189,8 @@ func RemoveGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.T
 
 	w.Header().Set("Content-Type", "application/json")
 	if rowsAffected > 0 {
+		audit.Record(db, r, user.UID, event.GiftDeleted, audit.EntityGift, currentGift.ID, currentOwner, currentGift.withoutClaim(), nil)
+		publish(event.GiftDeleted, user.UID, currentOwner, listId, &Gift{ID: currentGift.ID})
 		json.NewEncoder(w).Encode(util.Response{Success: true})
 	} else {
 		w.WriteHeader(http.StatusNotFound)
@@ -146,28 +199,30 @@ func RemoveGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.T
 }
 
 func ClaimGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	giftId := params["giftId"]
 
 	listId := params["listId"]
-	currentOwner, err := util.GetListOwner(db, listId)
+	currentOwner, manager, err := util.GetListOwner(ctx, db, listId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	areFriends, err := util.AreFriends(db, currentOwner, user.UID)
+	canSee, err := util.CanSeeList(ctx, db, user.UID, listId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	if (currentOwner == user.UID) || (!areFriends) {
+	// Parents can't claim from their managed profiles' lists, as they mustn't see the claims
+	if (manager == user.UID) || (!canSee) {
 		util.EncodeUnauthorised(w)
 		return
 	}
 
 	var claim Claim
-	err = db.QueryRow("SELECT claim_status, claimed_by FROM gifts WHERE id = ?", giftId).Scan(
-		&claim.State, &claim.User)
+	err = db.QueryRowContext(ctx, "SELECT claim_status, claimed_by, claim_updated, claim_expires FROM gifts WHERE id = ? AND list_id = ? AND deleted_at IS NULL", giftId, listId).Scan(
+		&claim.State, &claim.User, &claim.Updated, &claim.Expires)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -177,20 +232,78 @@ func ClaimGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.To
 
 	if (len(claim.User) == 0) || (claim.User == claimee) {
 		var newClaim Claim
-		json.NewDecoder(r.Body).Decode(&newClaim)
+		err := json.NewDecoder(r.Body).Decode(&newClaim)
+		if err != nil {
+			util.EncodeBadRequest(w, err.Error())
+			return
+		}
+		if !claim.State.CanBecome(newClaim.State) {
+			util.EncodeBadRequest(w, "cannot go from "+claim.State.String()+" to "+newClaim.State.String())
+			return
+		}
 
+		before := claim
+		now := time.Now().UTC()
 		claim.User = claimee
 		claim.State = newClaim.State
+		claim.Updated = &now
+		claim.Expires = nil
 
-		if claim.State == 0 {
+		if claim.State == Unclaimed {
 			claim.User = ""
 		}
+		if claim.State == Reserved && newClaim.Expires != nil {
+			if !newClaim.Expires.After(now) {
+				util.EncodeBadRequest(w, "expires must be in the future")
+				return
+			}
+			claim.Expires = newClaim.Expires
+		}
 
-		_, err := db.Exec("UPDATE gifts SET claim_status = ?, claimed_by = ? WHERE id = ?", claim.State, claim.User, giftId)
+		// Only update the claim if it's still in the state the transition was
+		// checked from, so neither someone else claiming the gift, nor another
+		// change or the reservation expiring in the meantime, can be skipped over
+		res, err := db.ExecContext(ctx, "UPDATE gifts SET claim_status = ?, claimed_by = ?, claim_updated = ?, claim_expires = ? WHERE id = ? AND deleted_at IS NULL AND claim_status = ? AND claimed_by = ?",
+			claim.State, claim.User, claim.Updated, claim.Expires, giftId, before.State, before.User)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		rowsAffected, err := res.RowsAffected()
 		if err != nil {
 			util.EncodeError(w, err)
 			return
 		}
+		if rowsAffected == 0 {
+			// Nothing changed either because the claim changed first, or because it was already identical
+			var (
+				state     ClaimState
+				claimedBy string
+			)
+			err := db.QueryRowContext(ctx, "SELECT claim_status, claimed_by FROM gifts WHERE id = ?", giftId).Scan(&state, &claimedBy)
+			if err != nil {
+				util.EncodeError(w, err)
+				return
+			}
+			if len(claimedBy) > 0 && claimedBy != claimee {
+				util.EncodeUnauthorised(w)
+				return
+			}
+			if state != claim.State || claimedBy != claim.User {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(util.Response{Success: false, Message: "claim has changed, it's now " + state.String()})
+				return
+			}
+		}
+
+		id, _ := strconv.ParseInt(giftId, 10, 64)
+		eventType := event.GiftClaimed
+		if claim.State == Unclaimed {
+			eventType = event.GiftUnclaimed
+		}
+		audit.Record(db, r, user.UID, eventType, audit.EntityGift, id, currentOwner, before, claim)
+		publish(eventType, user.UID, currentOwner, listId, &Gift{ID: id, Claim: &claim})
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(claim)
@@ -198,3 +311,127 @@ func ClaimGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.To
 		util.EncodeUnauthorised(w)
 	}
 }
+
+func ArchiveGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	setGiftTime(w, r, db, user, "archived_at", true, event.GiftArchived)
+}
+
+func RestoreGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	setGiftTime(w, r, db, user, "archived_at", false, event.GiftRestored)
+}
+
+func ReceiveGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	setGiftTime(w, r, db, user, "received_at", true, event.GiftReceived)
+}
+
+func UnreceiveGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	setGiftTime(w, r, db, user, "received_at", false, event.GiftUpdated)
+}
+
+// setGiftTime sets or clears one of the owner-only timestamp columns on a gift.
+// column is never user input.
+func setGiftTime(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token, column string, set bool, eventType string) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	giftId := params["giftId"]
+
+	listId := params["listId"]
+	currentOwner, manager, err := util.GetListOwner(ctx, db, listId)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if manager != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	currentGift, err := getGift(ctx, db, giftId, listId)
+	if err == sql.ErrNoRows {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "gift not found"})
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	before := currentGift.withoutClaim()
+
+	var (
+		res   sql.Result
+		value *time.Time
+	)
+	if set {
+		now := time.Now().UTC()
+		value = &now
+		res, err = db.ExecContext(ctx, "UPDATE gifts SET "+column+" = ? WHERE id = ? AND list_id = ? AND "+column+" IS NULL AND deleted_at IS NULL", now, giftId, listId)
+	} else {
+		res, err = db.ExecContext(ctx, "UPDATE gifts SET "+column+" = NULL WHERE id = ? AND list_id = ? AND "+column+" IS NOT NULL AND deleted_at IS NULL", giftId, listId)
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		after := before
+		if column == "archived_at" {
+			after.Archived = value
+		} else {
+			after.Received = value
+		}
+		audit.Record(db, r, user.UID, eventType, audit.EntityGift, currentGift.ID, currentOwner, before, after)
+		publish(eventType, user.UID, currentOwner, listId, &Gift{ID: currentGift.ID})
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "gift not found"})
+	}
+}
+
+func UndoRemoveGift(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	giftId := params["giftId"]
+
+	listId := params["listId"]
+	currentOwner, manager, err := util.GetListOwner(ctx, db, listId)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if manager != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE gifts SET deleted_at = NULL WHERE id = ? AND list_id = ? AND deleted_at >= ?", giftId, listId, time.Now().UTC().Add(-util.UndoWindow))
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		id, _ := strconv.ParseInt(giftId, 10, 64)
+		audit.Record(db, r, user.UID, event.GiftRestored, audit.EntityGift, id, currentOwner, nil, Gift{ID: id})
+		publish(event.GiftRestored, user.UID, currentOwner, listId, &Gift{ID: id})
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "no deleted gift to restore"})
+	}
+}
@@ -0,0 +1,72 @@
+package health
+
+import (
+	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout limits how long each readiness check can take, so a probe gets
+// an answer before it gives up itself.
+const checkTimeout = 2 * time.Second
+
+// Status is the body of health responses. Checks holds "ok" or "error" for
+// each dependency. The errors themselves are only logged, as they can include
+// hosts and other details of the setup.
+type Status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Live reports that the server is running. It doesn't check dependencies, so
+// an outage elsewhere doesn't get the server restarted.
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Status{Status: "ok"})
+}
+
+// Ready reports whether the server can handle requests, by checking it can
+// reach the database and Firebase. It responds with a 503 if either is down.
+func Ready(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	checks := map[string]func(context.Context) error{
+		"database": db.PingContext,
+		"firebase": authHelper.Ping,
+	}
+
+	status := Status{Status: "ok", Checks: map[string]string{}}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			defer cancel()
+			err := check(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("error checking %s: %v\n", name, err)
+				status.Status = "unavailable"
+				status.Checks[name] = "error"
+			} else {
+				status.Checks[name] = "ok"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
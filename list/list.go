@@ -1,14 +1,20 @@
 package list
 
 import (
+	"github.com/mrbbot/gift-list-api/audit"
 	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"github.com/mrbbot/gift-list-api/circle"
+	"github.com/mrbbot/gift-list-api/event"
 	"github.com/mrbbot/gift-list-api/gift"
 	"github.com/mrbbot/gift-list-api/util"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"firebase.google.com/go/auth"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type List struct {
@@ -16,13 +22,42 @@ type List struct {
 	Name        string       `json:"name"`
 	Owner       string       `json:"owner"`
 	Description string       `json:"description"`
-	Gifts       []*gift.Gift `json:"gifts"`
+	Occasion    *util.Date   `json:"occasion,omitempty"`
+	Archived    *time.Time   `json:"archived,omitempty"`
+	// Circles the list is shared with, only shown to the owner. Lists that
+	// aren't shared with any circles can be seen by all of the owner's friends.
+	Circles []int64      `json:"circles,omitempty"`
+	Gifts   []*gift.Gift `json:"gifts"`
 }
 
-func getListGifts(db *sql.DB, listId int64) ([]*gift.Gift, error) {
+// shared returns the list as friends see it, without its circles.
+func (list List) shared() List {
+	list.Circles = nil
+	return list
+}
+
+func getList(ctx context.Context, db *sql.DB, id string) (List, error) {
+	var list List
+	err := db.QueryRowContext(ctx, "SELECT id, name, owner, description, occasion, archived_at FROM lists WHERE id = ? AND deleted_at IS NULL", id).Scan(&list.ID, &list.Name, &list.Owner, &list.Description, &list.Occasion, &list.Archived)
+	return list, err
+}
+
+// getListGifts returns a page of a list's gifts, or all of them if page.Limit
+// is 0.
+func getListGifts(ctx context.Context, db *sql.DB, listId int64, includeArchived bool, page util.Page) ([]*gift.Gift, error) {
 	gifts := []*gift.Gift{}
 
-	rows, err := db.Query("SELECT gifts.id, gifts.name, gifts.description, gifts.url, gifts.image_url, gifts.claim_status, gifts.claimed_by FROM lists, gifts WHERE lists.id = gifts.list_id AND lists.id = ?", listId)
+	query := "SELECT gifts.id, gifts.name, gifts.description, gifts.url, gifts.image_url, gifts.received_at, gifts.archived_at, gifts.claim_status, gifts.claimed_by, gifts.claim_updated, gifts.claim_expires FROM lists, gifts WHERE lists.id = gifts.list_id AND lists.id = ? AND lists.deleted_at IS NULL AND gifts.deleted_at IS NULL AND gifts.id > ?"
+	if !includeArchived {
+		query += " AND gifts.archived_at IS NULL"
+	}
+	query += " ORDER BY gifts.id"
+	args := []interface{}{listId, page.Cursor}
+	if page.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, page.Limit)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -31,13 +66,13 @@ func getListGifts(db *sql.DB, listId int64) ([]*gift.Gift, error) {
 	for rows.Next() {
 		var g gift.Gift
 		g.Claim = &gift.Claim{}
-		err := rows.Scan(&g.ID, &g.Name, &g.Description, &g.Url, &g.ImageUrl, &g.Claim.State, &g.Claim.User)
+		err := rows.Scan(&g.ID, &g.Name, &g.Description, &g.Url, &g.ImageUrl, &g.Received, &g.Archived, &g.Claim.State, &g.Claim.User, &g.Claim.Updated, &g.Claim.Expires)
 		if err != nil {
 			return nil, err
 		}
 
 		if len(g.Claim.User) != 0 {
-			user, err := authHelper.UserFromUID(g.Claim.User)
+			user, err := authHelper.UserFromUID(ctx, g.Claim.User)
 			if err != nil {
 				return nil, err
 			}
@@ -51,10 +86,27 @@ func getListGifts(db *sql.DB, listId int64) ([]*gift.Gift, error) {
 	return gifts, nil
 }
 
+// manages reports whether the user can edit lists owned by owner: their own, or
+// those of the profiles they manage.
+func manages(ctx context.Context, db *sql.DB, uid string, owner string) (bool, error) {
+	manager, err := util.GetManager(ctx, db, owner)
+	return manager == uid, err
+}
+
+// hideClaims removes the claims from gifts on a managed profile's list when
+// its parent is looking, as only the list owner's friends should know about
+// them.
+func hideClaims(gifts []*gift.Gift) {
+	for _, g := range gifts {
+		g.Claim = nil
+	}
+}
+
 func GetLists(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	userId := params["userId"]
-	areFriends, err := util.AreFriends(db, user.UID, userId)
+	areFriends, err := util.AreFriends(ctx, db, user.UID, userId)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -64,9 +116,26 @@ func GetLists(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Tok
 		return
 	}
 
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+	includeArchived := r.URL.Query().Get("include") == "archived"
+	manager, err := util.GetManager(ctx, db, userId)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
 	lists := []List{}
 
-	rows, err := db.Query("SELECT * FROM lists WHERE owner = ?", userId)
+	query := "SELECT id, name, owner, description, occasion, archived_at FROM lists WHERE owner = ? AND deleted_at IS NULL AND id > ? AND " + util.ListVisibleTo
+	if !includeArchived {
+		query += " AND archived_at IS NULL"
+	}
+	query += " ORDER BY id LIMIT ?"
+	rows, err := db.QueryContext(ctx, query, userId, page.Cursor, user.UID, user.UID, user.UID, page.Limit)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -75,62 +144,241 @@ func GetLists(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Tok
 
 	for rows.Next() {
 		var list List
-		err := rows.Scan(&list.ID, &list.Name, &list.Owner, &list.Description)
+		err := rows.Scan(&list.ID, &list.Name, &list.Owner, &list.Description, &list.Occasion, &list.Archived)
 		if err != nil {
 			util.EncodeError(w, err)
 			return
 		}
 
-		list.Gifts, err = getListGifts(db, list.ID)
+		list.Gifts, err = getListGifts(ctx, db, list.ID, includeArchived, util.Page{})
 		if err != nil {
 			util.EncodeError(w, err)
 			return
 		}
+		if manager == user.UID {
+			if list.Owner != user.UID {
+				hideClaims(list.Gifts)
+			}
+			list.Circles, err = circle.GetListCircles(ctx, db, list.ID)
+			if err != nil {
+				util.EncodeError(w, err)
+				return
+			}
+		}
 
 		lists = append(lists, list)
 	}
 
+	if len(lists) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(lists), lists[len(lists)-1].ID)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(lists)
 }
 
+// GetSharedLists returns owner's current lists that viewer would be able to see
+// if they were friends, without any claims. It's used to show Secret Santa
+// participants their recipient's lists.
+func GetSharedLists(ctx context.Context, db *sql.DB, owner string, viewer string) ([]List, error) {
+	lists := []List{}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, name, owner, description, occasion, archived_at FROM lists WHERE owner = ? AND deleted_at IS NULL AND archived_at IS NULL AND "+util.ListVisibleTo+" ORDER BY id", owner, viewer, viewer, viewer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var list List
+		err := rows.Scan(&list.ID, &list.Name, &list.Owner, &list.Description, &list.Occasion, &list.Archived)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range lists {
+		lists[i].Gifts, err = getListGifts(ctx, db, lists[i].ID, false, util.Page{})
+		if err != nil {
+			return nil, err
+		}
+		hideClaims(lists[i].Gifts)
+	}
+	return lists, nil
+}
+
+// getVisibleList returns the list in the URL and whether the user manages it if
+// they're allowed to see it, otherwise writing the error response and returning
+// false.
+func getVisibleList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) (List, bool, bool) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	list, err := getList(ctx, db, params["listId"])
+	if err == sql.ErrNoRows {
+		util.EncodeNotFound(w)
+		return list, false, false
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return list, false, false
+	}
+
+	canSee, err := util.CanSeeList(ctx, db, user.UID, list.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return list, false, false
+	}
+	if !canSee {
+		util.EncodeUnauthorised(w)
+		return list, false, false
+	}
+	managed, err := manages(ctx, db, user.UID, list.Owner)
+	if err != nil {
+		util.EncodeError(w, err)
+		return list, false, false
+	}
+	return list, managed, true
+}
+
+func GetList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	list, managed, ok := getVisibleList(w, r, db, user)
+	if !ok {
+		return
+	}
+
+	var err error
+	list.Gifts, err = getListGifts(ctx, db, list.ID, r.URL.Query().Get("include") == "archived", util.Page{})
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if managed {
+		if list.Owner != user.UID {
+			hideClaims(list.Gifts)
+		}
+		list.Circles, err = circle.GetListCircles(ctx, db, list.ID)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func GetListGifts(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+	list, managed, ok := getVisibleList(w, r, db, user)
+	if !ok {
+		return
+	}
+
+	gifts, err := getListGifts(ctx, db, list.ID, r.URL.Query().Get("include") == "archived", page)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if managed && list.Owner != user.UID {
+		hideClaims(gifts)
+	}
+
+	if len(gifts) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(gifts), gifts[len(gifts)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gifts)
+}
+
 func CreateList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	var list List
 	json.NewDecoder(r.Body).Decode(&list)
-	list.Owner = user.UID
-
-	res, err := db.Exec("INSERT INTO lists (name, owner, description) VALUES (?, ?, ?)", list.Name, list.Owner, list.Description)
+	// Parents can create lists for the profiles they manage
+	if len(list.Owner) == 0 {
+		list.Owner = user.UID
+	}
+	managed, err := manages(ctx, db, user.UID, list.Owner)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
+	if !managed {
+		util.EncodeUnauthorised(w)
+		return
+	}
 
-	list.ID, err = res.LastInsertId()
+	// The list is only seen once it's shared with its circles, rather than with
+	// all friends in the meantime
+	err = util.Transact(ctx, db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "INSERT INTO lists (name, owner, description, occasion) VALUES (?, ?, ?, ?)", list.Name, list.Owner, list.Description, list.Occasion)
+		if err != nil {
+			return err
+		}
+		list.ID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return circle.SetListCircles(ctx, tx, user.UID, list.ID, list.Circles)
+	})
+	if err == circle.ErrNotFound {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
 
 	list.Gifts = []*gift.Gift{}
+	list.Circles, err = circle.GetListCircles(ctx, db, list.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	audit.Record(db, r, user.UID, event.ListCreated, audit.EntityList, list.ID, list.Owner, nil, list)
+	event.Publish(event.Event{Type: event.ListCreated, Actor: user.UID, Owner: list.Owner, ListID: list.ID, Data: list.shared()})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(list)
 }
 
 func EditList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	id := params["listId"]
 
-	var currentList List
-	err := db.QueryRow("SELECT * FROM lists WHERE id = ?", id).Scan(&currentList.ID, &currentList.Name, &currentList.Owner, &currentList.Description)
+	currentList, err := getList(ctx, db, id)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	managed, err := manages(ctx, db, user.UID, currentList.Owner)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	if currentList.Owner != user.UID {
+	if !managed {
 		util.EncodeUnauthorised(w)
 		return
 	}
+	currentList.Circles, err = circle.GetListCircles(ctx, db, currentList.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	before := currentList
 
 	var newList List
 	json.NewDecoder(r.Body).Decode(&newList)
@@ -140,32 +388,62 @@ func EditList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Tok
 	if len(newList.Description) > 0 {
 		currentList.Description = newList.Description
 	}
-
-	_, err = db.Exec("UPDATE lists SET name = ?, description = ? WHERE id = ?", currentList.Name, currentList.Description, id)
+	if newList.Occasion != nil {
+		currentList.Occasion = newList.Occasion
+	}
+	err = util.Transact(ctx, db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE lists SET name = ?, description = ?, occasion = ? WHERE id = ?", currentList.Name, currentList.Description, currentList.Occasion, id)
+		if err != nil || newList.Circles == nil {
+			return err
+		}
+		// An empty array shares the list with all friends again
+		return circle.SetListCircles(ctx, tx, user.UID, currentList.ID, newList.Circles)
+	})
+	if err == circle.ErrNotFound {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
+	if newList.Circles != nil {
+		currentList.Circles, err = circle.GetListCircles(ctx, db, currentList.ID)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+	}
+
+	audit.Record(db, r, user.UID, event.ListUpdated, audit.EntityList, currentList.ID, currentList.Owner, before, currentList)
+	event.Publish(event.Event{Type: event.ListUpdated, Actor: user.UID, Owner: currentList.Owner, ListID: currentList.ID, Data: currentList.shared()})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(currentList)
 }
 
 func RemoveList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
 	params := mux.Vars(r)
 	id := params["listId"]
 
-	currentOwner, err := util.GetListOwner(db, id)
+	currentList, err := getList(ctx, db, id)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	managed, err := manages(ctx, db, user.UID, currentList.Owner)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
 	}
-	if currentOwner != user.UID {
+	if !managed {
 		util.EncodeUnauthorised(w)
 		return
 	}
 
-	res, err := db.Exec("DELETE FROM lists WHERE id = ?", id)
+	// Lists are only marked as deleted so they can be restored, and are purged later
+	res, err := db.ExecContext(ctx, "UPDATE lists SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now().UTC(), id)
 	if err != nil {
 		util.EncodeError(w, err)
 		return
@@ -178,9 +456,125 @@ func RemoveList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.T
 
 	w.Header().Set("Content-Type", "application/json")
 	if rowsAffected > 0 {
+		audit.Record(db, r, user.UID, event.ListDeleted, audit.EntityList, currentList.ID, currentList.Owner, currentList, nil)
+		event.Publish(event.Event{Type: event.ListDeleted, Actor: user.UID, Owner: currentList.Owner, ListID: currentList.ID, Data: List{ID: currentList.ID, Owner: currentList.Owner}})
 		json.NewEncoder(w).Encode(util.Response{Success: true})
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "list not found"})
 	}
 }
+
+func ArchiveList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	setArchived(w, r, db, user, true)
+}
+
+func RestoreList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	setArchived(w, r, db, user, false)
+}
+
+func setArchived(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token, archived bool) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["listId"]
+
+	currentList, err := getList(ctx, db, id)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	managed, err := manages(ctx, db, user.UID, currentList.Owner)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if !managed {
+		util.EncodeUnauthorised(w)
+		return
+	}
+	before := currentList
+
+	var (
+		res       sql.Result
+		eventType string
+		message   string
+	)
+	if archived {
+		now := time.Now().UTC()
+		res, err = db.ExecContext(ctx, "UPDATE lists SET archived_at = ? WHERE id = ? AND archived_at IS NULL", now, id)
+		currentList.Archived = &now
+		eventType = event.ListArchived
+		message = "list already archived"
+	} else {
+		currentList.Archived = nil
+		res, err = db.ExecContext(ctx, "UPDATE lists SET archived_at = NULL WHERE id = ? AND archived_at IS NOT NULL", id)
+		eventType = event.ListRestored
+		message = "list not archived"
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		audit.Record(db, r, user.UID, eventType, audit.EntityList, currentList.ID, currentList.Owner, before, currentList)
+		event.Publish(event.Event{Type: eventType, Actor: user.UID, Owner: currentList.Owner, ListID: currentList.ID, Data: List{ID: currentList.ID, Owner: currentList.Owner}})
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: message})
+	}
+}
+
+func UndoRemoveList(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["listId"]
+
+	cutoff := time.Now().UTC().Add(-util.UndoWindow)
+	var owner string
+	err := db.QueryRowContext(ctx, "SELECT owner FROM lists WHERE id = ? AND deleted_at >= ?", id, cutoff).Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		util.EncodeError(w, err)
+		return
+	}
+	if err == nil {
+		managed, err := manages(ctx, db, user.UID, owner)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		if !managed {
+			util.EncodeUnauthorised(w)
+			return
+		}
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE lists SET deleted_at = NULL WHERE id = ? AND owner = ? AND deleted_at >= ?", id, owner, cutoff)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		listId, _ := strconv.ParseInt(id, 10, 64)
+		audit.Record(db, r, user.UID, event.ListRestored, audit.EntityList, listId, owner, nil, List{ID: listId, Owner: owner})
+		event.Publish(event.Event{Type: event.ListRestored, Actor: user.UID, Owner: owner, ListID: listId, Data: List{ID: listId, Owner: owner}})
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "no deleted list to restore"})
+	}
+}
@@ -1,83 +1,284 @@
 package main
 
 import (
+	"github.com/mrbbot/gift-list-api/audit"
 	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"github.com/mrbbot/gift-list-api/circle"
+	"github.com/mrbbot/gift-list-api/config"
+	"github.com/mrbbot/gift-list-api/feed"
 	"github.com/mrbbot/gift-list-api/friend"
 	"github.com/mrbbot/gift-list-api/gift"
+	"github.com/mrbbot/gift-list-api/health"
 	"github.com/mrbbot/gift-list-api/list"
+	"github.com/mrbbot/gift-list-api/metrics"
+	"github.com/mrbbot/gift-list-api/middleware"
+	"github.com/mrbbot/gift-list-api/openapi"
+	"github.com/mrbbot/gift-list-api/profile"
+	"github.com/mrbbot/gift-list-api/purge"
+	"github.com/mrbbot/gift-list-api/ratelimit"
+	"github.com/mrbbot/gift-list-api/reminder"
+	"github.com/mrbbot/gift-list-api/santa"
+	"github.com/mrbbot/gift-list-api/search"
+	"github.com/mrbbot/gift-list-api/settings"
+	"github.com/mrbbot/gift-list-api/stream"
+	"github.com/mrbbot/gift-list-api/tracing"
 	"github.com/mrbbot/gift-list-api/util"
+	"github.com/mrbbot/gift-list-api/webhook"
+	"context"
 	"database/sql"
 	"firebase.google.com/go/auth"
+	"github.com/XSAM/otelsql"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 	"github.com/rs/cors"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 //TODO: Consider optimising with prepared statements
 func main() {
-	err := godotenv.Load()
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		log.Fatalf("error loading .env file: %v\n", err)
+		log.Fatalf("error loading config: %v\n", err)
 	}
 
-	db, err := sql.Open("mysql", os.Getenv("DB"))
+	shutdownTracing, err := tracing.Init(cfg.Tracing, cfg.OTLPEndpoint)
+	if err != nil {
+		log.Fatalf("error initializing tracing: %v\n", err)
+	}
+
+	// Every statement is traced as a child of the request that ran it
+	db, err := otelsql.Open("mysql", cfg.DB, otelsql.WithAttributes(semconv.DBSystemNameMySQL), otelsql.WithSpanOptions(otelsql.SpanOptions{
+		OmitConnResetSession: true,
+		OmitRows:             true,
+		DisableErrSkip:       true,
+	}))
 	if err != nil {
 		log.Fatalf("error initializing database: %v\n", err)
 	}
 	defer db.Close()
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	err = waitForDB(db, cfg.DBStartupTimeout)
+	if err != nil {
+		log.Fatalf("error connecting to database: %v\n", err)
+	}
 
-	authHelper.Init()
+	authHelper.Init(cfg.Credentials)
+	gift.Init(db)
+	friend.Init(db, cfg.FriendRequestExpiry)
+	webhook.Init(db)
+	stream.Init(db)
+	feed.Init(db)
+	reminder.Init(db)
+	purge.Init(db)
+	metrics.Init(db)
 
-	inject := func(f func(http.ResponseWriter, *http.Request, *sql.DB, *auth.Token)) func(http.ResponseWriter, *http.Request) {
-		return func(w http.ResponseWriter, r *http.Request) {
-			token, err := authHelper.Verify(r.Header.Get("Authorization"))
+	// Scan searching works without FULLTEXT indexes, for stores that don't support them
+	if cfg.Search == "scan" {
+		search.Use(search.Scan{})
+	}
+
+	limiter := ratelimit.NewMemory()
+	router := newRouter(cfg, db, limiter)
 
-			if err != nil {
-				log.Printf("<UNAUTHORISED> (%v) -> [%s] %v\n", err, r.Method, r.RequestURI)
-				util.EncodeUnauthorised(w)
-				return
-			}
+	handler := middleware.Chain(cors.New(cors.Options{
+		AllowedHeaders: []string{"Authorization", "Content-Type", middleware.RequestIDHeader},
+		ExposedHeaders: []string{util.NextCursorHeader, friend.NextIncomingCursorHeader, friend.NextOutgoingCursorHeader, middleware.RequestIDHeader, "Retry-After"},
+		AllowedMethods: []string{"GET", "POST", "DELETE"},
+		AllowedOrigins: cfg.CORSOrigins,
+	}).Handler(middleware.Metrics(router)),
+		middleware.RequestID,
+		middleware.AccessLog,
+		middleware.Recover,
+		middleware.BodyLimit(cfg.MaxBodyBytes),
+		middleware.RateLimit(limiter, ratelimit.Rule{Name: "ip", Limit: cfg.IPRateLimit, Period: time.Minute}, middleware.IPKey(cfg.TrustProxy)),
+	)
+
+	server := &http.Server{
+		Addr:         cfg.Address,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	server.RegisterOnShutdown(stream.Close)
 
-			log.Printf("%s -> [%s] %v\n", token.UID, r.Method, r.RequestURI)
-			f(w, r, db, token)
+	go func() {
+		var err error
+		if cfg.SSL {
+			err = server.ListenAndServeTLS(cfg.Cert, cfg.Key)
+		} else {
+			err = server.ListenAndServe()
 		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("error serving: %v\n", err)
+		}
+	}()
+
+	// Stop accepting connections on SIGTERM, and give requests in progress time
+	// to finish before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	log.Println("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("error shutting down: %v\n", err)
+	}
+	err = shutdownTracing(ctx)
+	if err != nil {
+		log.Printf("error flushing traces: %v\n", err)
+	}
+}
+
+// newRouter registers every route, with the middleware each one needs. Rate
+// limits are counted by limiter, shared with the per-IP limit applied to all
+// requests.
+func newRouter(cfg config.Config, db *sql.DB, limiter ratelimit.Limiter) *mux.Router {
+	// Each user has a general rate limit, and stricter ones for adding friends,
+	// which would otherwise let emails be checked for accounts, and claiming
+	friendLimit := middleware.RateLimit(limiter, ratelimit.Rule{Name: "friend", Limit: cfg.FriendRateLimit, Period: time.Hour}, middleware.UserKey)
+	claimLimit := middleware.RateLimit(limiter, ratelimit.Rule{Name: "claim", Limit: cfg.ClaimRateLimit, Period: time.Hour}, middleware.UserKey)
+	userLimit := middleware.RateLimit(limiter, ratelimit.Rule{Name: "user", Limit: cfg.UserRateLimit, Period: time.Minute}, middleware.UserKey)
+
+	// inject adapts handlers to take the database and the token Auth verified,
+	// applying any extra middleware after authentication. Requests are cancelled
+	// after the configured timeout, which stops any queries or Firebase calls
+	// they're waiting on.
+	inject := func(f func(http.ResponseWriter, *http.Request, *sql.DB, *auth.Token), extra ...middleware.Middleware) func(http.ResponseWriter, *http.Request) {
+		return middleware.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f(w, r, db, middleware.Token(r))
+		}), append([]middleware.Middleware{middleware.Timeout(cfg.RequestTimeout), middleware.Auth(middleware.HeaderToken), userLimit}, extra...)...).ServeHTTP
+	}
+
+	// EventSource can't set headers, so streaming routes take the token as a query parameter instead.
+	// Streams stay open, so they don't get a timeout.
+	injectQuery := func(f func(http.ResponseWriter, *http.Request, *sql.DB, *auth.Token)) func(http.ResponseWriter, *http.Request) {
+		return middleware.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f(w, r, db, middleware.Token(r))
+		}), middleware.Auth(middleware.QueryToken), userLimit).ServeHTTP
 	}
 
 	router := mux.NewRouter()
+	router.Use(middleware.Trace)
 
-	router.HandleFunc("/lists/{userId}", inject(list.GetLists)).Methods("GET")
-	router.HandleFunc("/list", inject(list.CreateList)).Methods("POST")
-	router.HandleFunc("/list/{listId}", inject(list.EditList)).Methods("POST")
-	router.HandleFunc("/list/{listId}", inject(list.RemoveList)).Methods("DELETE")
+	// Monitoring routes don't need a token, so probes and scrapers can reach them
+	router.HandleFunc("/metrics", metrics.Handler).Methods("GET")
+	router.HandleFunc("/healthz", health.Live).Methods("GET")
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		health.Ready(w, r, db)
+	}).Methods("GET")
 
-	router.HandleFunc("/list/{listId}/gift", inject(gift.CreateGift)).Methods("POST")
-	router.HandleFunc("/list/{listId}/gift/{giftId}", inject(gift.EditGift)).Methods("POST")
-	router.HandleFunc("/list/{listId}/gift/{giftId}", inject(gift.RemoveGift)).Methods("DELETE")
-	router.HandleFunc("/list/{listId}/gift/{giftId}/claim", inject(gift.ClaimGift)).Methods("POST")
+	// The API is versioned by path, so breaking changes can be made under a new
+	// prefix while clients move over
+	v1 := router.PathPrefix(openapi.BasePath).Subrouter()
+	v1.HandleFunc("/openapi.json", openapi.Handler).Methods("GET")
+	v1.HandleFunc("/docs", openapi.Docs).Methods("GET")
 
-	router.HandleFunc("/friends", inject(friend.GetFriends)).Methods("GET")
-	router.HandleFunc("/friend", inject(friend.AddFriend)).Methods("POST")
-	router.HandleFunc("/friend/accept/{friendId}", inject(friend.AcceptFriend)).Methods("POST")
-	router.HandleFunc("/friend/reject/{friendId}", inject(friend.RejectFriend)).Methods("POST")
-	router.HandleFunc("/friend/{friendId}", inject(friend.RemoveFriend)).Methods("DELETE")
+	v1.HandleFunc("/lists/{userId}", inject(list.GetLists)).Methods("GET")
+	v1.HandleFunc("/list", inject(list.CreateList)).Methods("POST")
+	v1.HandleFunc("/list/{listId}", inject(list.GetList)).Methods("GET")
+	v1.HandleFunc("/list/{listId}", inject(list.EditList)).Methods("POST")
+	v1.HandleFunc("/list/{listId}", inject(list.RemoveList)).Methods("DELETE")
+	v1.HandleFunc("/list/{listId}/gifts", inject(list.GetListGifts)).Methods("GET")
+	v1.HandleFunc("/list/{listId}/undo", inject(list.UndoRemoveList)).Methods("POST")
+	v1.HandleFunc("/list/{listId}/archive", inject(list.ArchiveList)).Methods("POST")
+	v1.HandleFunc("/list/{listId}/restore", inject(list.RestoreList)).Methods("POST")
 
-	handler := cors.New(cors.Options{
-		AllowedHeaders: []string{"Authorization", "Content-Type"},
-		AllowedMethods: []string{"GET", "POST", "DELETE"},
-	}).Handler(router)
-
-	address := os.Getenv("ADDRESS")
-	useSSL, err := strconv.ParseBool(os.Getenv("SSL"))
-	if useSSL {
-		certPath := os.Getenv("CERT")
-		keyPath := os.Getenv("KEY")
-		log.Fatal(http.ListenAndServeTLS(address, certPath, keyPath, handler))
-	} else {
-		log.Fatal(http.ListenAndServe(address, handler))
+	v1.HandleFunc("/list/{listId}/gift", inject(gift.CreateGift)).Methods("POST")
+	v1.HandleFunc("/list/{listId}/gift/{giftId}", inject(gift.EditGift)).Methods("POST")
+	v1.HandleFunc("/list/{listId}/gift/{giftId}", inject(gift.RemoveGift)).Methods("DELETE")
+	v1.HandleFunc("/list/{listId}/gift/{giftId}/undo", inject(gift.UndoRemoveGift)).Methods("POST")
+	v1.HandleFunc("/list/{listId}/gift/{giftId}/claim", inject(gift.ClaimGift, claimLimit)).Methods("POST")
+	v1.HandleFunc("/list/{listId}/gift/{giftId}/received", inject(gift.ReceiveGift)).Methods("POST")
+	v1.HandleFunc("/list/{listId}/gift/{giftId}/received", inject(gift.UnreceiveGift)).Methods("DELETE")
+	v1.HandleFunc("/list/{listId}/gift/{giftId}/archive", inject(gift.ArchiveGift)).Methods("POST")
+	v1.HandleFunc("/list/{listId}/gift/{giftId}/restore", inject(gift.RestoreGift)).Methods("POST")
+
+	v1.HandleFunc("/friends", inject(friend.GetFriends)).Methods("GET")
+	v1.HandleFunc("/friend", inject(friend.AddFriend, friendLimit)).Methods("POST")
+	v1.HandleFunc("/friend/accept/{friendId}", inject(friend.AcceptFriend)).Methods("POST")
+	v1.HandleFunc("/friend/reject/{friendId}", inject(friend.RejectFriend)).Methods("POST")
+	v1.HandleFunc("/friend/cancel/{friendId}", inject(friend.CancelFriend)).Methods("POST")
+	v1.HandleFunc("/friend/{friendId}", inject(friend.RemoveFriend)).Methods("DELETE")
+	v1.HandleFunc("/friend/{friendId}/undo", inject(friend.UndoRemoveFriend)).Methods("POST")
+	v1.HandleFunc("/profiles", inject(profile.GetProfiles)).Methods("GET")
+	v1.HandleFunc("/profile", inject(profile.CreateProfile)).Methods("POST")
+	v1.HandleFunc("/profile/{profileId}", inject(profile.EditProfile)).Methods("POST")
+	v1.HandleFunc("/profile/{profileId}", inject(profile.RemoveProfile)).Methods("DELETE")
+
+	v1.HandleFunc("/circles", inject(circle.GetCircles)).Methods("GET")
+	v1.HandleFunc("/circle", inject(circle.CreateCircle)).Methods("POST")
+	v1.HandleFunc("/circle/{circleId}", inject(circle.EditCircle)).Methods("POST")
+	v1.HandleFunc("/circle/{circleId}", inject(circle.RemoveCircle)).Methods("DELETE")
+	v1.HandleFunc("/circle/{circleId}/member/{userId}", inject(circle.AddMember)).Methods("POST")
+	v1.HandleFunc("/circle/{circleId}/member/{userId}", inject(circle.RemoveMember)).Methods("DELETE")
+
+	v1.HandleFunc("/blocks", inject(friend.GetBlocks)).Methods("GET")
+	v1.HandleFunc("/block/{userId}", inject(friend.BlockUser)).Methods("POST")
+	v1.HandleFunc("/block/{userId}", inject(friend.UnblockUser)).Methods("DELETE")
+	v1.HandleFunc("/friend/invites", inject(friend.GetInvites)).Methods("GET")
+	v1.HandleFunc("/friend/invite", inject(friend.CreateInvite)).Methods("POST")
+	v1.HandleFunc("/friend/invite/{inviteId}", inject(friend.RevokeInvite)).Methods("DELETE")
+	v1.HandleFunc("/friend/invite/{token}/redeem", inject(friend.RedeemInvite)).Methods("POST")
+
+	v1.HandleFunc("/santas", inject(santa.GetGroups)).Methods("GET")
+	v1.HandleFunc("/santa", inject(santa.CreateGroup)).Methods("POST")
+	v1.HandleFunc("/santa/{groupId}", inject(santa.GetGroup)).Methods("GET")
+	v1.HandleFunc("/santa/{groupId}", inject(santa.EditGroup)).Methods("POST")
+	v1.HandleFunc("/santa/{groupId}", inject(santa.RemoveGroup)).Methods("DELETE")
+	v1.HandleFunc("/santa/{groupId}/draw", inject(santa.Draw)).Methods("POST")
+	v1.HandleFunc("/santa/{groupId}/reveal", inject(santa.Reveal)).Methods("POST")
+	v1.HandleFunc("/santa/{groupId}/recipient", inject(santa.GetRecipient)).Methods("GET")
+
+	v1.HandleFunc("/feed", inject(feed.GetFeed)).Methods("GET")
+	v1.HandleFunc("/search", inject(search.Search)).Methods("GET")
+	v1.HandleFunc("/audit", inject(audit.GetAudit)).Methods("GET")
+
+	v1.HandleFunc("/settings", inject(settings.GetSettings)).Methods("GET")
+	v1.HandleFunc("/settings", inject(settings.EditSettings)).Methods("POST")
+	v1.HandleFunc("/reminders", inject(reminder.GetReminders)).Methods("GET")
+
+	v1.HandleFunc("/stream", injectQuery(stream.Stream)).Methods("GET")
+
+	v1.HandleFunc("/webhooks", inject(webhook.GetWebhooks)).Methods("GET")
+	v1.HandleFunc("/webhook", inject(webhook.CreateWebhook)).Methods("POST")
+	v1.HandleFunc("/webhook/{webhookId}", inject(webhook.RemoveWebhook)).Methods("DELETE")
+	v1.HandleFunc("/webhooks/dead", inject(webhook.GetDeadLetters)).Methods("GET")
+	v1.HandleFunc("/webhooks/dead/{deliveryId}/retry", inject(webhook.RetryDelivery)).Methods("POST")
+
+	return router
+}
+
+// waitForDB pings the database until it responds, backing off between
+// attempts, and gives up after timeout.
+func waitForDB(db *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Printf("database not ready, retrying in %v: %v\n", backoff, err)
+		time.Sleep(backoff)
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
 	}
 }
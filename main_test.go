@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/mrbbot/gift-list-api/config"
+	"github.com/mrbbot/gift-list-api/openapi"
+	"github.com/mrbbot/gift-list-api/ratelimit"
+	"testing"
+)
+
+func TestRoutesDocumented(t *testing.T) {
+	// Registering routes doesn't touch the database, so none is needed
+	router := newRouter(config.Default(), nil, ratelimit.NewMemory())
+	if err := openapi.Check(router); err != nil {
+		t.Fatal(err)
+	}
+}
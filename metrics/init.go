@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"github.com/mrbbot/gift-list-api/event"
+	"database/sql"
+)
+
+// Events counts published events by type, which covers claims
+// (gift.claimed), friend requests (friend.requested) and everything else
+// users do.
+var Events = NewCounter("events_total", "Events published, by type.", "type")
+
+// Init registers the database connection pool's stats and starts counting
+// events.
+func Init(db *sql.DB) {
+	NewGaugeFunc("db_max_open_connections", "Maximum number of open database connections.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	NewGaugeFunc("db_open_connections", "Database connections open, in use or idle.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	NewGaugeFunc("db_in_use_connections", "Database connections in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	NewGaugeFunc("db_idle_connections", "Idle database connections.", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	NewCounterFunc("db_wait_total", "Times a query had to wait for a database connection.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	NewCounterFunc("db_wait_seconds_total", "Time spent waiting for database connections.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+	NewCounterFunc("db_closed_max_lifetime_total", "Database connections closed for reaching their maximum lifetime.", func() float64 {
+		return float64(db.Stats().MaxLifetimeClosed)
+	})
+
+	// Every type starts at zero, so rates work from the first event
+	for _, t := range event.Types {
+		Events.Add(0, t)
+	}
+	event.Subscribe(func(e event.Event) {
+		Events.Inc(e.Type)
+	})
+}
@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics are exposed in the Prometheus text format, version 0.0.4. Only the
+// parts needed here are implemented: counters and histograms with labels, and
+// gauges and counters read when scraped.
+
+// Namespace prefixes the name of every metric.
+const Namespace = "giftlist_"
+
+// DefaultBuckets are histogram buckets in seconds, suitable for request
+// latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	mu         sync.Mutex
+	registered []metric
+)
+
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	registered = append(registered, m)
+}
+
+// Handler writes every registered metric.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mu.Lock()
+	metrics := append([]metric{}, registered...)
+	mu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// series holds the label values of one time series, keyed by them joined.
+type series struct {
+	mu     sync.Mutex
+	names  []string
+	values map[string][]string
+}
+
+func (s *series) key(values []string) string {
+	if len(values) != len(s.names) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(s.names), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// sorted returns the keys of every series, so they're written in a stable
+// order.
+func (s *series) sorted() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *series) labels(key string, extra ...string) string {
+	values := s.values[key]
+	var pairs []string
+	for i, name := range s.names {
+		pairs = append(pairs, name+"="+quote(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+func format(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Counter is a count that only goes up, split by labels.
+type Counter struct {
+	name   string
+	help   string
+	series series
+	counts map[string]float64
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		name:   Namespace + name,
+		help:   help,
+		series: series{names: labels, values: map[string][]string{}},
+		counts: map[string]float64{},
+	}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds v, which mustn't be negative, to the series with the given label
+// values.
+func (c *Counter) Add(v float64, labels ...string) {
+	key := c.series.key(labels)
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	if _, ok := c.series.values[key]; !ok {
+		c.series.values[key] = append([]string{}, labels...)
+	}
+	c.counts[key] += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range c.series.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.series.labels(key), format(c.counts[key]))
+	}
+}
+
+// Histogram counts observations into buckets, split by labels.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	series  series
+	counts  map[string][]uint64
+	sums    map[string]float64
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds, in
+// increasing order, and label names.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    Namespace + name,
+		help:    help,
+		buckets: buckets,
+		series:  series{names: labels, values: map[string][]string{}},
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+	}
+	register(h)
+	return h
+}
+
+// Observe records v in the series with the given label values.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	key := h.series.key(labels)
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	counts, ok := h.counts[key]
+	if !ok {
+		h.series.values[key] = append([]string{}, labels...)
+		// The last count is for the +Inf bucket
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[key] = counts
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	counts[i]++
+	h.sums[key] += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range h.series.sorted() {
+		var cumulative uint64
+		counts := h.counts[key]
+		for i, count := range counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.series.labels(key, "le", format(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.series.labels(key), format(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.series.labels(key), cumulative)
+	}
+}
+
+// funcMetric is read from f whenever it's scraped.
+type funcMetric struct {
+	name string
+	help string
+	kind string
+	f    func() float64
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	writeHeader(w, m.name, m.help, m.kind)
+	fmt.Fprintf(w, "%s %s\n", m.name, format(m.f()))
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f when scraped.
+func NewGaugeFunc(name string, help string, f func() float64) {
+	register(&funcMetric{name: Namespace + name, help: help, kind: "gauge", f: f})
+}
+
+// NewCounterFunc registers a counter whose value is read from f when scraped.
+func NewCounterFunc(name string, help string, f func() float64) {
+	register(&funcMetric{name: Namespace + name, help: help, kind: "counter", f: f})
+}
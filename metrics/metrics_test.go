@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func written(m metric) string {
+	var b bytes.Buffer
+	m.write(&b)
+	return b.String()
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A test counter.", "method", "path")
+	c.Inc("GET", "/b")
+	c.Add(2.5, "GET", "/b")
+	c.Inc("POST", `/a"\`+"\n")
+
+	want := `# HELP giftlist_test_counter_total A test counter.
+# TYPE giftlist_test_counter_total counter
+giftlist_test_counter_total{method="GET",path="/b"} 3.5
+giftlist_test_counter_total{method="POST",path="/a\"\\\n"} 1
+`
+	if got := written(c); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	c := NewCounter("test_unlabelled_total", "A counter without labels.")
+	c.Inc()
+
+	want := `# HELP giftlist_test_unlabelled_total A counter without labels.
+# TYPE giftlist_test_unlabelled_total counter
+giftlist_test_unlabelled_total 1
+`
+	if got := written(c); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterLabelCount(t *testing.T) {
+	c := NewCounter("test_label_count_total", "A counter given the wrong labels.", "method")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for the wrong number of label values")
+		}
+	}()
+	c.Inc("GET", "/")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_seconds", "A test histogram.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/")
+	h.Observe(0.1, "/")
+	h.Observe(0.5, "/")
+	h.Observe(2, "/")
+
+	// Buckets are cumulative, and a value on a bound goes in that bucket
+	want := `# HELP giftlist_test_seconds A test histogram.
+# TYPE giftlist_test_seconds histogram
+giftlist_test_seconds_bucket{route="/",le="0.1"} 2
+giftlist_test_seconds_bucket{route="/",le="1"} 3
+giftlist_test_seconds_bucket{route="/",le="+Inf"} 4
+giftlist_test_seconds_sum{route="/"} 2.65
+giftlist_test_seconds_count{route="/"} 4
+`
+	if got := written(h); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFuncMetrics(t *testing.T) {
+	value := 1.0
+	NewGaugeFunc("test_gauge", "A test gauge.", func() float64 {
+		return value
+	})
+	NewCounterFunc("test_func_total", "A test counter read when scraped.", func() float64 {
+		return 7
+	})
+	value = 3
+
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("got content type %q", got)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE giftlist_test_gauge gauge\ngiftlist_test_gauge 3\n",
+		"# TYPE giftlist_test_func_total counter\ngiftlist_test_func_total 7\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+}
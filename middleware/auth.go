@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"firebase.google.com/go/auth"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+type contextKey int
+
+const tokenKey contextKey = iota
+
+// Auth verifies the Firebase ID token idToken finds in each request, and puts
+// it in the request's context for Token. Requests without a valid token get a
+// 401.
+func Auth(idToken func(*http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := authHelper.Verify(r.Context(), idToken(r))
+			if err != nil {
+				util.EncodeUnauthorised(w)
+				return
+			}
+
+			if rw, ok := w.(*responseWriter); ok {
+				rw.uid = token.UID
+			}
+			trace.SpanFromContext(r.Context()).SetAttributes(semconv.UserID(token.UID))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey, token)))
+		})
+	}
+}
+
+// HeaderToken takes the token from the Authorization header.
+func HeaderToken(r *http.Request) string {
+	return r.Header.Get("Authorization")
+}
+
+// QueryToken takes the token from the token query parameter, for EventSource
+// which can't set headers. It's removed from the request so it can't end up in
+// logs.
+func QueryToken(r *http.Request) string {
+	query := r.URL.Query()
+	token := query.Get("token")
+	query.Del("token")
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+	return token
+}
+
+// Token returns the token Auth verified for the request, or nil outside of it.
+func Token(r *http.Request) *auth.Token {
+	token, _ := r.Context().Value(tokenKey).(*auth.Token)
+	return token
+}
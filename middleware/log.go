@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// logger writes one JSON line per request to stderr, where the standard logger
+// also writes.
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+// responseWriter records what's written so it can be logged. Auth fills in the
+// user, and util.LogError the reason a request failed.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	uid    string
+	err    string
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush is needed for streams to send events as they happen.
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// LogError implements util.ErrorLogger.
+func (w *responseWriter) LogError(message string) {
+	w.err = message
+}
+
+// AccessLog logs every request once it's finished, with its status, size and
+// how long it took. Query strings aren't logged, as streams carry the user's
+// token in them.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", r.Header.Get(RequestIDHeader)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int64("bytes", rw.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote", r.RemoteAddr),
+		}
+		if len(rw.uid) > 0 {
+			attrs = append(attrs, slog.String("uid", rw.uid))
+		}
+		if len(rw.err) > 0 {
+			attrs = append(attrs, slog.String("error", rw.err))
+		}
+		logger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
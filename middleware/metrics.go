@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"github.com/mrbbot/gift-list-api/metrics"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requests = metrics.NewCounter("http_requests_total", "HTTP requests handled, by route and status.", "method", "route", "status")
+	latency  = metrics.NewHistogram("http_request_duration_seconds", "Time taken to handle HTTP requests, by route.", metrics.DefaultBuckets, "method", "route")
+)
+
+// unmatchedRoute labels requests no route matched, which get a 404 or 405.
+const unmatchedRoute = "unmatched"
+
+// Metrics counts requests and times them by route, labelling them with the
+// route's template rather than the path so IDs don't make a series each. It
+// wraps the whole router rather than being router middleware, which only runs
+// for matched routes, so 404s and 405s are counted too.
+func Metrics(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := unmatchedRoute
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		rw, ok := w.(*responseWriter)
+		if !ok {
+			rw = &responseWriter{ResponseWriter: w}
+		}
+
+		start := time.Now()
+		completed := false
+		defer func() {
+			status := rw.status
+			if !completed {
+				// The handler panicked, and Recover will respond with a 500
+				status = http.StatusInternalServerError
+			} else if status == 0 {
+				status = http.StatusOK
+			}
+			requests.Inc(r.Method, route, strconv.Itoa(status))
+			latency.Observe(time.Since(start).Seconds(), r.Method, route)
+		}()
+		router.ServeHTTP(rw, r)
+		completed = true
+	})
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"github.com/mrbbot/gift-list-api/metrics"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCountsUnmatchedRequests(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/test/item/{itemId}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}).Methods("POST")
+	handler := Metrics(router)
+
+	for _, request := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"POST", "/test/item/1", http.StatusCreated},
+		{"GET", "/test/item/1", http.StatusMethodNotAllowed},
+		{"GET", "/test/missing", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(request.method, request.path, nil))
+		if w.Code != request.status {
+			t.Errorf("%s %s got status %d, want %d", request.method, request.path, w.Code, request.status)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	metrics.Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`giftlist_http_requests_total{method="POST",route="/test/item/{itemId}",status="201"} 1`,
+		`giftlist_http_requests_total{method="GET",route="unmatched",status="405"} 1`,
+		`giftlist_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+}
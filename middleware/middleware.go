@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a handler with behaviour that runs around it.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h with each middleware, the first being the outermost.
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// RequestIDHeader carries the ID of each request, both ways.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID gives every request an ID, keeping one set by the client or a proxy
+// if it looks sensible. It's echoed in the response and left in the request
+// header for util.RequestID.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Recover turns a panic in a handler into a 500 response, so the client gets
+// an answer and the connection isn't dropped. The panic and its stack trace are
+// logged with the request.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// Handlers panic with this on purpose to abort the response
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			util.LogError(w, fmt.Sprintf("panic: %v\n%s", p, debug.Stack()))
+			if rw, ok := w.(*responseWriter); ok && rw.status != 0 {
+				// Too late to change the response
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(util.Response{Success: false, Message: "internal server error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BodyLimit rejects request bodies bigger than limit bytes. Ones that say how
+// big they are up front are refused straight away, and the rest fail to read
+// past the limit.
+func BodyLimit(limit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				util.LogError(w, fmt.Sprintf("body of %d bytes is over the limit", r.ContentLength))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode(util.Response{Success: false, Message: "request body too large"})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Timeout cancels the request's context after timeout, which stops any
+// queries or Firebase calls it's waiting on. A timeout of 0 means no limit.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
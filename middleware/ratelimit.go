@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"github.com/mrbbot/gift-list-api/metrics"
+	"github.com/mrbbot/gift-list-api/ratelimit"
+	"github.com/mrbbot/gift-list-api/util"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var limited = metrics.NewCounter("rate_limited_total", "Requests refused for going over a rate limit, by rule.", "rule")
+
+// RateLimit refuses requests with a 429 once the bucket for rule and the key
+// returned by key is empty, saying when to retry in the Retry-After header.
+// Requests with an empty key aren't limited.
+func RateLimit(limiter ratelimit.Limiter, rule ratelimit.Rule, key func(*http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if len(k) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			allowed, wait := limiter.Allow(rule, k)
+			if !allowed {
+				limited.Inc(rule.Name)
+				util.LogError(w, "rate limited by "+rule.Name)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(util.Response{Success: false, Message: "too many requests"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UserKey keys requests by the UID Auth verified, so it has to come after Auth.
+func UserKey(r *http.Request) string {
+	if token := Token(r); token != nil {
+		return token.UID
+	}
+	return ""
+}
+
+// IPKey keys requests by the client's IP address. Behind a proxy, every request
+// comes from the proxy, so with trustProxy the address the proxy appended to
+// X-Forwarded-For is used instead. Earlier addresses in the header are ignored,
+// as clients can set them to anything.
+func IPKey(trustProxy bool) func(*http.Request) string {
+	return func(r *http.Request) string {
+		if trustProxy {
+			forwarded := r.Header.Values("X-Forwarded-For")
+			if len(forwarded) > 0 {
+				last := forwarded[len(forwarded)-1]
+				return strings.TrimSpace(last[strings.LastIndex(last, ",")+1:])
+			}
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
@@ -0,0 +1,26 @@
+-- Webhook subscriptions and their delivery queue.
+-- Timestamps are scanned into time.Time, so the DB connection string must include parseTime=true.
+
+CREATE TABLE webhooks (
+  id         INT AUTO_INCREMENT PRIMARY KEY,
+  owner      VARCHAR(128)  NOT NULL,
+  url        VARCHAR(2048) NOT NULL,
+  events     VARCHAR(512)  NOT NULL DEFAULT '',
+  secret     VARCHAR(64)   NOT NULL,
+  created_at DATETIME      NOT NULL,
+  INDEX (owner)
+);
+
+CREATE TABLE webhook_deliveries (
+  id           INT AUTO_INCREMENT PRIMARY KEY,
+  webhook_id   INT          NOT NULL,
+  event        VARCHAR(64)  NOT NULL,
+  payload      TEXT         NOT NULL,
+  attempts     INT          NOT NULL DEFAULT 0,
+  status       VARCHAR(16)  NOT NULL,
+  last_error   TEXT         NOT NULL,
+  next_attempt DATETIME     NOT NULL,
+  created_at   DATETIME     NOT NULL,
+  INDEX (status, next_attempt),
+  FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
@@ -0,0 +1,26 @@
+-- Occasion dates, per-user reminder settings and the reminder scheduler's state.
+
+ALTER TABLE lists ADD COLUMN occasion DATE NULL;
+
+CREATE TABLE users (
+  uid           VARCHAR(128) PRIMARY KEY,
+  birthday      DATE         NULL,
+  reminder_days INT          NOT NULL DEFAULT 14,
+  reminders     BOOLEAN      NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE reminders (
+  id         INT AUTO_INCREMENT PRIMARY KEY,
+  recipient  VARCHAR(128)  NOT NULL,
+  kind       VARCHAR(16)   NOT NULL,
+  subject    VARCHAR(160)  NOT NULL,
+  occasion   DATE          NOT NULL,
+  message    VARCHAR(1024) NOT NULL,
+  created_at DATETIME      NOT NULL,
+  UNIQUE (recipient, kind, subject, occasion)
+);
+
+CREATE TABLE scheduler_runs (
+  job      VARCHAR(64) PRIMARY KEY,
+  last_run DATE        NOT NULL
+);
@@ -0,0 +1,21 @@
+-- Claim lifecycle timestamps. claim_status now holds 0 = unclaimed, 1 = reserved, 2 = purchased, 3 = delivered.
+
+ALTER TABLE gifts
+  ADD COLUMN claim_updated DATETIME NULL,
+  ADD COLUMN claim_expires DATETIME NULL,
+  ADD INDEX (claim_status, claim_expires);
+
+-- Any number could be stored before, which didn't mean any of these states, and states without transitions couldn't be
+-- changed, even by the claimer. Claims someone holds become reservations, and everything else is unclaimed.
+UPDATE gifts
+SET claim_status = 1
+WHERE claimed_by != '' AND claim_status != 0;
+
+UPDATE gifts
+SET claim_status = 0, claimed_by = ''
+WHERE claimed_by = '' OR claim_status = 0;
+
+-- Existing claims count as updated now
+UPDATE gifts
+SET claim_updated = UTC_TIMESTAMP()
+WHERE claimed_by != '';
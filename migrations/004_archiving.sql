@@ -0,0 +1,7 @@
+-- Owners can mark gifts as received and archive lists and gifts instead of deleting them.
+
+ALTER TABLE lists ADD COLUMN archived_at DATETIME NULL;
+
+ALTER TABLE gifts
+  ADD COLUMN received_at DATETIME NULL,
+  ADD COLUMN archived_at DATETIME NULL;
@@ -0,0 +1,8 @@
+-- Removed lists, gifts and friendships are kept until they're purged, so they can be restored.
+
+ALTER TABLE lists ADD COLUMN deleted_at DATETIME NULL, ADD INDEX (deleted_at);
+ALTER TABLE gifts ADD COLUMN deleted_at DATETIME NULL, ADD INDEX (deleted_at);
+ALTER TABLE friends
+  ADD COLUMN deleted_at DATETIME     NULL,
+  ADD COLUMN deleted_by VARCHAR(128) NOT NULL DEFAULT '',
+  ADD INDEX (deleted_at);
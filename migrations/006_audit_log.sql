@@ -0,0 +1,17 @@
+-- Append-only record of every change made through the API. Nothing updates or deletes these rows.
+
+CREATE TABLE audit_log (
+  id          BIGINT AUTO_INCREMENT PRIMARY KEY,
+  actor       VARCHAR(128) NOT NULL,
+  action      VARCHAR(64)  NOT NULL,
+  entity      VARCHAR(16)  NOT NULL,
+  entity_id   BIGINT       NOT NULL,
+  owner       VARCHAR(128) NOT NULL,
+  before_json TEXT         NULL,
+  after_json  TEXT         NULL,
+  request_id  VARCHAR(64)  NOT NULL DEFAULT '',
+  created_at  DATETIME     NOT NULL,
+  INDEX (owner, id),
+  INDEX (actor, id),
+  INDEX (entity, entity_id)
+);
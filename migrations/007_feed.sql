@@ -0,0 +1,15 @@
+-- Activity shown in friends' feeds. owner is the user whose friends can see the item.
+
+CREATE TABLE feed_items (
+  id         BIGINT AUTO_INCREMENT PRIMARY KEY,
+  type       VARCHAR(64)  NOT NULL,
+  actor      VARCHAR(128) NOT NULL,
+  owner      VARCHAR(128) NOT NULL,
+  list_id    INT          NULL,
+  friend     VARCHAR(128) NOT NULL DEFAULT '',
+  count      INT          NOT NULL DEFAULT 1,
+  created_at DATETIME     NOT NULL,
+  updated_at DATETIME     NOT NULL,
+  INDEX (owner, id),
+  INDEX (type, actor, list_id, updated_at)
+);
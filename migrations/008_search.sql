@@ -0,0 +1,5 @@
+-- Indexes for full-text search of list names and gift names and descriptions. Servers started with SEARCH=scan don't
+-- need them.
+
+ALTER TABLE lists ADD FULLTEXT INDEX search_name (name);
+ALTER TABLE gifts ADD FULLTEXT INDEX search_name_description (name, description);
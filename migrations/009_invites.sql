@@ -0,0 +1,17 @@
+-- Friend invites. Token invites are redeemed by whoever has the token, email invites (with a NULL token) become friend
+-- requests once someone signs up with the email.
+
+CREATE TABLE invites (
+  id         BIGINT AUTO_INCREMENT PRIMARY KEY,
+  owner      VARCHAR(128) NOT NULL,
+  token      VARCHAR(64)  NULL,
+  email      VARCHAR(320) NULL,
+  max_uses   INT          NOT NULL DEFAULT 1,
+  uses       INT          NOT NULL DEFAULT 0,
+  expires_at DATETIME     NOT NULL,
+  revoked_at DATETIME     NULL,
+  created_at DATETIME     NOT NULL,
+  UNIQUE (token),
+  INDEX (owner, id),
+  INDEX (email)
+);
@@ -0,0 +1,17 @@
+-- Blocked users, and rejected friend requests so they can't be sent again straight away.
+
+CREATE TABLE blocks (
+  id         BIGINT AUTO_INCREMENT PRIMARY KEY,
+  owner      VARCHAR(128) NOT NULL,
+  blocked    VARCHAR(128) NOT NULL,
+  created_at DATETIME     NOT NULL,
+  UNIQUE (owner, blocked),
+  INDEX (blocked)
+);
+
+CREATE TABLE friend_rejections (
+  requester   VARCHAR(128) NOT NULL,
+  addressee   VARCHAR(128) NOT NULL,
+  rejected_at DATETIME     NOT NULL,
+  PRIMARY KEY (requester, addressee)
+);
@@ -0,0 +1,24 @@
+-- Circles of friends, and the circles lists are shared with. Lists without any rows in list_circles are shared with all
+-- of the owner's friends.
+
+CREATE TABLE circles (
+  id         BIGINT AUTO_INCREMENT PRIMARY KEY,
+  owner      VARCHAR(128) NOT NULL,
+  name       VARCHAR(255) NOT NULL,
+  created_at DATETIME     NOT NULL,
+  INDEX (owner, id)
+);
+
+CREATE TABLE circle_members (
+  circle_id BIGINT       NOT NULL,
+  member    VARCHAR(128) NOT NULL,
+  PRIMARY KEY (circle_id, member),
+  INDEX (member)
+);
+
+CREATE TABLE list_circles (
+  list_id   INT    NOT NULL,
+  circle_id BIGINT NOT NULL,
+  PRIMARY KEY (list_id, circle_id),
+  INDEX (circle_id)
+);
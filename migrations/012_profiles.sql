@@ -0,0 +1,13 @@
+-- Managed profiles for people without their own account, such as young children. Their uid is used as the owner of
+-- their lists, and their parent manages them.
+
+CREATE TABLE profiles (
+  id         BIGINT AUTO_INCREMENT PRIMARY KEY,
+  uid        VARCHAR(128)  NOT NULL,
+  parent     VARCHAR(128)  NOT NULL,
+  name       VARCHAR(255)  NOT NULL,
+  photo      VARCHAR(2048) NOT NULL DEFAULT '',
+  created_at DATETIME      NOT NULL,
+  UNIQUE (uid),
+  INDEX (parent)
+);
@@ -0,0 +1,38 @@
+-- Secret Santa groups. The seed is kept so a draw can be repeated and checked, but it's only shown once the organiser
+-- reveals the assignments.
+
+CREATE TABLE santa_groups (
+  id          BIGINT AUTO_INCREMENT PRIMARY KEY,
+  organiser   VARCHAR(128) NOT NULL,
+  name        VARCHAR(255) NOT NULL,
+  budget      INT          NOT NULL DEFAULT 0,
+  currency    VARCHAR(3)   NOT NULL DEFAULT '',
+  seed        BIGINT       NULL,
+  drawn_at    DATETIME     NULL,
+  revealed_at DATETIME     NULL,
+  created_at  DATETIME     NOT NULL,
+  INDEX (organiser, id)
+);
+
+CREATE TABLE santa_members (
+  group_id BIGINT       NOT NULL,
+  member   VARCHAR(128) NOT NULL,
+  PRIMARY KEY (group_id, member),
+  INDEX (member)
+);
+
+-- Pairs of members who can't draw each other, in either direction
+CREATE TABLE santa_exclusions (
+  group_id BIGINT       NOT NULL,
+  a        VARCHAR(128) NOT NULL,
+  b        VARCHAR(128) NOT NULL,
+  PRIMARY KEY (group_id, a, b)
+);
+
+CREATE TABLE santa_assignments (
+  group_id  BIGINT       NOT NULL,
+  giver     VARCHAR(128) NOT NULL,
+  recipient VARCHAR(128) NOT NULL,
+  PRIMARY KEY (group_id, giver),
+  UNIQUE (group_id, recipient)
+);
@@ -0,0 +1,43 @@
+-- One row per pair of users instead of a row in each direction. user_low and user_high put the pair in a fixed order,
+-- and live is only set for rows that haven't been removed, so each pair can have one current friendship or request as
+-- well as any number of removed ones waiting to be restored or purged.
+
+CREATE TABLE friendships (
+  id           BIGINT AUTO_INCREMENT PRIMARY KEY,
+  requester    VARCHAR(128)                  NOT NULL,
+  addressee    VARCHAR(128)                  NOT NULL,
+  status       ENUM ('pending', 'accepted') NOT NULL DEFAULT 'pending',
+  requested_at DATETIME                      NOT NULL,
+  accepted_at  DATETIME                      NULL,
+  deleted_at   DATETIME                      NULL,
+  deleted_by   VARCHAR(128)                  NOT NULL DEFAULT '',
+  user_low     VARCHAR(128) AS (LEAST(requester, addressee)) STORED,
+  user_high    VARCHAR(128) AS (GREATEST(requester, addressee)) STORED,
+  live         TINYINT AS (IF(deleted_at IS NULL, 1, NULL)) STORED,
+  CHECK (requester <> addressee),
+  UNIQUE (user_low, user_high, live),
+  INDEX (requester, status),
+  INDEX (addressee, status),
+  INDEX (deleted_at)
+);
+
+-- Each accepted pair keeps the ID of its first row, which was the original request, and drops the mirror row added when
+-- it was accepted. Accepted rows go first so they win over any duplicate or crossed requests left behind by
+-- half-finished updates, which are ignored. The old rows don't record when they were made, so the time of the
+-- migration is used.
+INSERT IGNORE INTO friendships (id, requester, addressee, status, requested_at, accepted_at, deleted_at, deleted_by)
+SELECT friends.id, friends.owner, friends.friend, IF(friends.state, 'accepted', 'pending'), UTC_TIMESTAMP(),
+       IF(friends.state, UTC_TIMESTAMP(), NULL), friends.deleted_at, friends.deleted_by
+FROM friends
+WHERE friends.owner <> friends.friend
+  AND NOT EXISTS (SELECT 1
+                  FROM friends mirror
+                  WHERE mirror.owner = friends.friend
+                    AND mirror.friend = friends.owner
+                    AND mirror.state = friends.state
+                    AND mirror.deleted_at <=> friends.deleted_at
+                    AND mirror.id < friends.id)
+ORDER BY friends.state DESC, friends.id;
+
+-- Kept until the conversion has been checked, then it can be dropped
+RENAME TABLE friends TO friends_paired;
@@ -0,0 +1,23 @@
+-- Email invites become friend requests without an addressee, so adding a friend by email looks the same to the sender
+-- whether or not anyone has signed up with it. Every request keeps the email it was sent to, which is all the sender
+-- sees of a pending request, and the addressee is filled in once someone signs up with the email. A NULL addressee
+-- leaves user_low and user_high NULL too, so the unique key doesn't apply until then.
+
+ALTER TABLE friendships
+  MODIFY addressee VARCHAR(128) NULL,
+  ADD COLUMN email VARCHAR(320) NULL AFTER addressee,
+  ADD INDEX (email);
+
+INSERT INTO friendships (requester, addressee, email, status, requested_at)
+SELECT owner, NULL, email, 'pending', created_at
+FROM invites
+WHERE email IS NOT NULL
+  AND revoked_at IS NULL
+  AND uses < max_uses
+  AND expires_at > UTC_TIMESTAMP();
+
+DELETE FROM invites WHERE email IS NOT NULL;
+
+ALTER TABLE invites
+  DROP INDEX email,
+  DROP COLUMN email;
@@ -0,0 +1,9 @@
+-- Every friend request a user sends, kept whatever becomes of it, so cancelling or having requests rejected doesn't
+-- give back any of the daily limit.
+
+CREATE TABLE friend_request_attempts (
+  id           BIGINT AUTO_INCREMENT PRIMARY KEY,
+  requester    VARCHAR(128) NOT NULL,
+  attempted_at DATETIME     NOT NULL,
+  INDEX (requester, attempted_at)
+);
@@ -0,0 +1,5 @@
+-- Requests the addressee would never get, because of a block or a recent rejection, are stored as requests to their
+-- email that are never passed on, so the sender sees the same as when nobody has signed up with the email.
+
+ALTER TABLE friendships
+  ADD COLUMN suppressed BOOLEAN NOT NULL DEFAULT FALSE AFTER email;
@@ -0,0 +1,193 @@
+package openapi
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BasePath is where the current version of the API is mounted.
+const BasePath = "/v1"
+
+var pathParam = regexp.MustCompile(`{([^}]+)}`)
+
+var (
+	once    sync.Once
+	encoded []byte
+)
+
+// Spec builds the OpenAPI document for every route in the table.
+func Spec() Document {
+	g := newGenerator()
+	errorResponse := Response{
+		Description: "Error",
+		Content:     map[string]MediaType{"application/json": {Schema: g.schemaOf(util.Response{})}},
+	}
+
+	doc := Document{
+		OpenAPI: "3.0.3",
+		Info: Info{
+			Title:       "Gift List API",
+			Description: "Requests are authenticated with a Firebase ID token in the Authorization header. Every response may also be a 429 with Retry-After once a rate limit is hit.",
+			Version:     strings.TrimPrefix(BasePath, "/v"),
+		},
+		Servers:  []Server{{URL: BasePath}},
+		Security: []Requirement{{"firebase": {}}},
+		Paths:    map[string]PathItem{},
+		Components: Components{
+			SecuritySchemes: map[string]SecurityScheme{
+				"firebase":      {Type: "apiKey", In: "header", Name: "Authorization", Description: "Firebase ID token"},
+				"firebaseQuery": {Type: "apiKey", In: "query", Name: "token", Description: "Firebase ID token, for EventSource which can't set headers"},
+			},
+		},
+	}
+
+	seenTags := map[string]bool{}
+	for _, route := range routes {
+		if !seenTags[route.tag] {
+			seenTags[route.tag] = true
+			doc.Tags = append(doc.Tags, Tag{Name: route.tag})
+		}
+
+		op := &Operation{Summary: route.summary, Tags: []string{route.tag}}
+		for _, match := range pathParam.FindAllStringSubmatch(route.path, -1) {
+			op.Parameters = append(op.Parameters, Parameter{Name: match[1], In: "path", Required: true, Schema: str()})
+		}
+		for _, p := range route.query {
+			op.Parameters = append(op.Parameters, Parameter{Name: p.name, In: "query", Description: p.description, Schema: str()})
+		}
+		if route.body != nil {
+			op.RequestBody = &RequestBody{Content: map[string]MediaType{"application/json": {Schema: g.schemaOf(route.body)}}}
+		}
+
+		success := Response{Description: "Success", Headers: map[string]Header{}}
+		switch {
+		case len(route.contentType) > 0:
+			success.Content = map[string]MediaType{route.contentType: {Schema: str()}}
+		case route.response != nil:
+			success.Content = map[string]MediaType{"application/json": {Schema: g.schemaOf(route.response)}}
+		}
+		for name, header := range route.headers {
+			success.Headers[name] = header
+		}
+		if route.paged {
+			op.Parameters = append(op.Parameters,
+				Parameter{Name: "limit", In: "query", Description: "Items per page, up to " + strconv.Itoa(util.MaxPageLimit), Schema: integer()},
+				Parameter{Name: "cursor", In: "query", Description: "Cursor for the next page, from " + util.NextCursorHeader, Schema: str()},
+			)
+			success.Headers[util.NextCursorHeader] = Header{Description: "Cursor for the next page, set when this one was full", Schema: str()}
+		}
+		if len(success.Headers) == 0 {
+			success.Headers = nil
+		}
+
+		status := route.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		op.Responses = map[string]Response{strconv.Itoa(status): success}
+		switch {
+		case route.public:
+			op.Security = &[]Requirement{}
+		case route.queryToken:
+			op.Security = &[]Requirement{{"firebaseQuery": {}}}
+		}
+		if !route.public {
+			op.Responses["default"] = errorResponse
+		}
+
+		if doc.Paths[route.path] == nil {
+			doc.Paths[route.path] = PathItem{}
+		}
+		doc.Paths[route.path][strings.ToLower(route.method)] = op
+	}
+	doc.Components.Schemas = g.schemas
+	return doc
+}
+
+// Handler serves the OpenAPI document as JSON.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	once.Do(func() {
+		encoded, _ = json.Marshal(Spec())
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encoded)
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Gift List API</title>
+</head>
+<body>
+<redoc spec-url="openapi.json"></redoc>
+<script src="https://cdn.redoc.ly/redoc/latest/bundles/redoc.standalone.js"></script>
+</body>
+</html>
+`
+
+// Docs serves a page rendering the OpenAPI document with Redoc.
+func Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsPage))
+}
+
+// Check compares the routes registered under BasePath on router with the table
+// the document is built from. It returns an error listing routes that aren't
+// documented and documented routes that don't exist, so the two can't drift
+// apart. Unversioned routes, like the monitoring endpoints, aren't part of the
+// API and are skipped.
+func Check(router *mux.Router) error {
+	documented := map[string]bool{}
+	for _, route := range routes {
+		documented[route.method+" "+route.path] = true
+	}
+
+	var problems []string
+	registered := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		// The subrouter's own prefix route has no methods
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		if !strings.HasPrefix(path, BasePath+"/") {
+			return nil
+		}
+		path = strings.TrimPrefix(path, BasePath)
+		for _, method := range methods {
+			key := method + " " + path
+			registered[key] = true
+			if !documented[key] {
+				problems = append(problems, key+" isn't documented")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key := range documented {
+		if !registered[key] {
+			problems = append(problems, key+" is documented but not registered")
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("openapi: " + strings.Join(problems, ", "))
+	}
+	return nil
+}
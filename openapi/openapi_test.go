@@ -0,0 +1,57 @@
+package openapi
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func noop(w http.ResponseWriter, r *http.Request) {}
+
+// documented registers every route in the table under BasePath.
+func documented() (*mux.Router, *mux.Router) {
+	router := mux.NewRouter()
+	v1 := router.PathPrefix(BasePath).Subrouter()
+	for _, route := range routes {
+		v1.HandleFunc(route.path, noop).Methods(route.method)
+	}
+	return router, v1
+}
+
+func TestCheck(t *testing.T) {
+	router, _ := documented()
+	if err := Check(router); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSkipsUnversioned(t *testing.T) {
+	router, _ := documented()
+	router.HandleFunc("/metrics", noop).Methods("GET")
+	if err := Check(router); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckUndocumented(t *testing.T) {
+	router, v1 := documented()
+	v1.HandleFunc("/unknown", noop).Methods("POST")
+	err := Check(router)
+	if err == nil || !strings.Contains(err.Error(), "POST /unknown isn't documented") {
+		t.Fatalf("expected POST /unknown to be reported, got %v", err)
+	}
+}
+
+func TestCheckUnregistered(t *testing.T) {
+	router := mux.NewRouter()
+	v1 := router.PathPrefix(BasePath).Subrouter()
+	for _, route := range routes[1:] {
+		v1.HandleFunc(route.path, noop).Methods(route.method)
+	}
+	err := Check(router)
+	missing := routes[0].method + " " + routes[0].path + " is documented but not registered"
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("expected %q, got %v", missing, err)
+	}
+}
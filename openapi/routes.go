@@ -0,0 +1,162 @@
+package openapi
+
+import (
+	"github.com/mrbbot/gift-list-api/audit"
+	"github.com/mrbbot/gift-list-api/circle"
+	"github.com/mrbbot/gift-list-api/feed"
+	"github.com/mrbbot/gift-list-api/friend"
+	"github.com/mrbbot/gift-list-api/gift"
+	"github.com/mrbbot/gift-list-api/list"
+	"github.com/mrbbot/gift-list-api/profile"
+	"github.com/mrbbot/gift-list-api/reminder"
+	"github.com/mrbbot/gift-list-api/santa"
+	"github.com/mrbbot/gift-list-api/search"
+	"github.com/mrbbot/gift-list-api/settings"
+	"github.com/mrbbot/gift-list-api/util"
+	"github.com/mrbbot/gift-list-api/webhook"
+	"net/http"
+)
+
+// route documents one operation. Path is relative to BasePath, and its
+// parameters are taken from the {braces}. Body and Response are either values
+// whose types describe the JSON, or *Schema for types that aren't exported.
+type route struct {
+	method   string
+	path     string
+	tag      string
+	summary  string
+	query    []param
+	body     interface{}
+	status   int
+	response interface{}
+	headers  map[string]Header
+	// Takes limit and cursor, and sets X-Next-Cursor
+	paged bool
+	// Reads the token from the query string rather than the header
+	queryToken bool
+	public     bool
+	// Responds with something other than JSON
+	contentType string
+}
+
+type param struct {
+	name        string
+	description string
+}
+
+var includeArchived = param{"include", "archived to include archived items"}
+
+var ok = util.Response{}
+
+var email = object(map[string]*Schema{"email": &Schema{Type: "string", Format: "email"}})
+
+var friends = struct {
+	Current  []friend.Friend `json:"current"`
+	Incoming []friend.Friend `json:"incoming"`
+	Outgoing []friend.Friend `json:"outgoing"`
+}{}
+
+var inviteOptions = object(map[string]*Schema{
+	"maxUses": &Schema{Type: "integer", Format: "int64", Description: "0 for unlimited uses"},
+	"expires": &Schema{Type: "string", Format: "date-time"},
+})
+
+var settingsUpdate = object(map[string]*Schema{
+	"birthday":     &Schema{Type: "string", Format: "date"},
+	"reminderDays": integer(),
+	"reminders":    boolean(),
+})
+
+var routes = []route{
+	{method: "GET", path: "/openapi.json", tag: "Docs", summary: "This document", response: &Schema{Type: "object"}, public: true},
+	{method: "GET", path: "/docs", tag: "Docs", summary: "This document as a web page", public: true, contentType: "text/html"},
+
+	{method: "GET", path: "/lists/{userId}", tag: "Lists", summary: "Get a user's lists", query: []param{includeArchived}, response: []list.List{}, paged: true},
+	{method: "POST", path: "/list", tag: "Lists", summary: "Create a list", body: list.List{}, response: list.List{}},
+	{method: "GET", path: "/list/{listId}", tag: "Lists", summary: "Get a list and its gifts", query: []param{includeArchived}, response: list.List{}},
+	{method: "POST", path: "/list/{listId}", tag: "Lists", summary: "Edit a list", body: list.List{}, response: list.List{}},
+	{method: "DELETE", path: "/list/{listId}", tag: "Lists", summary: "Remove a list", response: ok},
+	{method: "GET", path: "/list/{listId}/gifts", tag: "Lists", summary: "Get a list's gifts", query: []param{includeArchived}, response: []gift.Gift{}, paged: true},
+	{method: "POST", path: "/list/{listId}/undo", tag: "Lists", summary: "Restore a removed list", response: ok},
+	{method: "POST", path: "/list/{listId}/archive", tag: "Lists", summary: "Archive a list", response: ok},
+	{method: "POST", path: "/list/{listId}/restore", tag: "Lists", summary: "Restore an archived list", response: ok},
+
+	{method: "POST", path: "/list/{listId}/gift", tag: "Gifts", summary: "Add a gift to a list", body: gift.Gift{}, response: gift.Gift{}},
+	{method: "POST", path: "/list/{listId}/gift/{giftId}", tag: "Gifts", summary: "Edit a gift", body: gift.Gift{}, response: gift.Gift{}},
+	{method: "DELETE", path: "/list/{listId}/gift/{giftId}", tag: "Gifts", summary: "Remove a gift", response: ok},
+	{method: "POST", path: "/list/{listId}/gift/{giftId}/undo", tag: "Gifts", summary: "Restore a removed gift", response: ok},
+	{method: "POST", path: "/list/{listId}/gift/{giftId}/claim", tag: "Gifts", summary: "Claim a gift, or change the state of a claim", body: gift.Claim{}, response: gift.Claim{}},
+	{method: "POST", path: "/list/{listId}/gift/{giftId}/received", tag: "Gifts", summary: "Mark a gift as received", response: ok},
+	{method: "DELETE", path: "/list/{listId}/gift/{giftId}/received", tag: "Gifts", summary: "Unmark a gift as received", response: ok},
+	{method: "POST", path: "/list/{listId}/gift/{giftId}/archive", tag: "Gifts", summary: "Archive a gift", response: ok},
+	{method: "POST", path: "/list/{listId}/gift/{giftId}/restore", tag: "Gifts", summary: "Restore an archived gift", response: ok},
+
+	{method: "GET", path: "/friends", tag: "Friends", summary: "Get friends and friend requests", query: []param{
+		{"circle", "Only friends in this circle"},
+		{"incomingCursor", "Cursor for the next page of incoming requests"},
+		{"outgoingCursor", "Cursor for the next page of outgoing requests"},
+	}, response: friends, paged: true, headers: map[string]Header{
+		friend.NextIncomingCursorHeader: {Description: "Cursor for the next page of incoming requests", Schema: str()},
+		friend.NextOutgoingCursorHeader: {Description: "Cursor for the next page of outgoing requests", Schema: str()},
+	}},
+	{method: "POST", path: "/friend", tag: "Friends", summary: "Send a friend request", body: email, status: http.StatusAccepted, response: ok},
+	{method: "POST", path: "/friend/accept/{friendId}", tag: "Friends", summary: "Accept a friend request", response: friend.Friend{}},
+	{method: "POST", path: "/friend/reject/{friendId}", tag: "Friends", summary: "Reject a friend request", response: ok},
+	{method: "POST", path: "/friend/cancel/{friendId}", tag: "Friends", summary: "Cancel a friend request", response: ok},
+	{method: "DELETE", path: "/friend/{friendId}", tag: "Friends", summary: "Remove a friend", response: ok},
+	{method: "POST", path: "/friend/{friendId}/undo", tag: "Friends", summary: "Restore a removed friend", response: friend.Friend{}},
+
+	{method: "GET", path: "/profiles", tag: "Profiles", summary: "Get the user's profiles", response: []profile.Profile{}},
+	{method: "POST", path: "/profile", tag: "Profiles", summary: "Create a profile", body: profile.Profile{}, response: profile.Profile{}},
+	{method: "POST", path: "/profile/{profileId}", tag: "Profiles", summary: "Edit a profile", body: profile.Profile{}, response: profile.Profile{}},
+	{method: "DELETE", path: "/profile/{profileId}", tag: "Profiles", summary: "Remove a profile", response: ok},
+
+	{method: "GET", path: "/circles", tag: "Circles", summary: "Get the user's circles", response: []circle.Circle{}, paged: true},
+	{method: "POST", path: "/circle", tag: "Circles", summary: "Create a circle", body: circle.Circle{}, response: circle.Circle{}},
+	{method: "POST", path: "/circle/{circleId}", tag: "Circles", summary: "Edit a circle", body: circle.Circle{}, response: circle.Circle{}},
+	{method: "DELETE", path: "/circle/{circleId}", tag: "Circles", summary: "Remove a circle", response: ok},
+	{method: "POST", path: "/circle/{circleId}/member/{userId}", tag: "Circles", summary: "Add a friend to a circle", response: circle.Circle{}},
+	{method: "DELETE", path: "/circle/{circleId}/member/{userId}", tag: "Circles", summary: "Remove a friend from a circle", response: ok},
+
+	{method: "GET", path: "/blocks", tag: "Blocking", summary: "Get blocked users", response: []friend.Block{}, paged: true},
+	{method: "POST", path: "/block/{userId}", tag: "Blocking", summary: "Block a user", response: friend.Block{}},
+	{method: "DELETE", path: "/block/{userId}", tag: "Blocking", summary: "Unblock a user", response: ok},
+
+	{method: "GET", path: "/friend/invites", tag: "Invites", summary: "Get the user's invite links", response: []friend.Invite{}, paged: true},
+	{method: "POST", path: "/friend/invite", tag: "Invites", summary: "Create an invite link", body: inviteOptions, response: friend.Invite{}},
+	{method: "DELETE", path: "/friend/invite/{inviteId}", tag: "Invites", summary: "Revoke an invite link", response: ok},
+	{method: "POST", path: "/friend/invite/{token}/redeem", tag: "Invites", summary: "Become friends with an invite's creator", response: friend.Friend{}},
+
+	{method: "GET", path: "/santas", tag: "Secret Santa", summary: "Get the user's groups", response: []santa.Group{}, paged: true},
+	{method: "POST", path: "/santa", tag: "Secret Santa", summary: "Create a group", body: santa.Group{}, response: santa.Group{}},
+	{method: "GET", path: "/santa/{groupId}", tag: "Secret Santa", summary: "Get a group", response: santa.Group{}},
+	{method: "POST", path: "/santa/{groupId}", tag: "Secret Santa", summary: "Edit a group", body: santa.Group{}, response: santa.Group{}},
+	{method: "DELETE", path: "/santa/{groupId}", tag: "Secret Santa", summary: "Remove a group", response: ok},
+	{method: "POST", path: "/santa/{groupId}/draw", tag: "Secret Santa", summary: "Draw who buys for who", response: santa.Group{}},
+	{method: "POST", path: "/santa/{groupId}/reveal", tag: "Secret Santa", summary: "Reveal the draw to every member", response: santa.Group{}},
+	{method: "GET", path: "/santa/{groupId}/recipient", tag: "Secret Santa", summary: "Get who the user is buying for", response: santa.Recipient{}},
+
+	{method: "GET", path: "/feed", tag: "Activity", summary: "Get friends' recent activity", response: []feed.Item{}, paged: true},
+	{method: "GET", path: "/search", tag: "Activity", summary: "Search friends' lists and gifts", query: []param{{"q", "Search terms"}}, response: []search.Result{}, paged: true},
+	{method: "GET", path: "/audit", tag: "Activity", summary: "Get the audit log", query: []param{
+		{"entity", "Only entries about this kind of entity"},
+		{"entityId", "Only entries about this entity"},
+		{"action", "Only entries for this action"},
+		{"actor", "Only entries by this user"},
+		{"owner", "Only entries about this user's things"},
+		{"requestId", "Only entries made by this request"},
+		{"since", "Only entries at or after this RFC 3339 time"},
+		{"until", "Only entries before this RFC 3339 time"},
+	}, response: []audit.Entry{}, paged: true},
+	{method: "GET", path: "/stream", tag: "Activity", summary: "Stream events as they happen", query: []param{{"owner", "Only events about this friend's lists"}}, queryToken: true, contentType: "text/event-stream"},
+
+	{method: "GET", path: "/settings", tag: "Settings", summary: "Get the user's settings", response: settings.Settings{}},
+	{method: "POST", path: "/settings", tag: "Settings", summary: "Change some of the user's settings", body: settingsUpdate, response: settings.Settings{}},
+	{method: "GET", path: "/reminders", tag: "Settings", summary: "Get upcoming reminders", response: []reminder.Reminder{}, paged: true},
+
+	{method: "GET", path: "/webhooks", tag: "Webhooks", summary: "Get the user's webhooks", response: []webhook.Webhook{}, paged: true},
+	{method: "POST", path: "/webhook", tag: "Webhooks", summary: "Create a webhook", body: webhook.Webhook{}, response: webhook.Webhook{}},
+	{method: "DELETE", path: "/webhook/{webhookId}", tag: "Webhooks", summary: "Remove a webhook", response: ok},
+	{method: "GET", path: "/webhooks/dead", tag: "Webhooks", summary: "Get deliveries that ran out of retries", response: []webhook.Delivery{}, paged: true},
+	{method: "POST", path: "/webhooks/dead/{deliveryId}/retry", tag: "Webhooks", summary: "Retry a dead delivery", response: ok},
+}
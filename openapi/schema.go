@@ -0,0 +1,225 @@
+package openapi
+
+import (
+	"github.com/mrbbot/gift-list-api/gift"
+	"github.com/mrbbot/gift-list-api/util"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Document is an OpenAPI 3 document, with only the fields used here.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Servers    []Server            `json:"servers"`
+	Security   []Requirement       `json:"security"`
+	Tags       []Tag               `json:"tags"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Tag struct {
+	Name string `json:"name"`
+}
+
+// Requirement names the security schemes an operation accepts.
+type Requirement map[string][]string
+
+// PathItem holds the operations on a path, keyed by lower case method.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Summary     string              `json:"summary"`
+	Tags        []string            `json:"tags,omitempty"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+	// Nil uses the document's security, empty means no token is needed
+	Security *[]Requirement `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Content map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	In          string `json:"in"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+func str() *Schema {
+	return &Schema{Type: "string"}
+}
+
+func integer() *Schema {
+	return &Schema{Type: "integer", Format: "int64"}
+}
+
+func boolean() *Schema {
+	return &Schema{Type: "boolean"}
+}
+
+func arrayOf(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+func object(properties map[string]*Schema) *Schema {
+	return &Schema{Type: "object", Properties: properties}
+}
+
+// special are types whose JSON isn't what their Go type suggests, as they
+// marshal themselves.
+var special = map[reflect.Type]func() *Schema{
+	reflect.TypeOf(time.Time{}): func() *Schema {
+		return &Schema{Type: "string", Format: "date-time"}
+	},
+	reflect.TypeOf(util.Date{}): func() *Schema {
+		return &Schema{Type: "string", Format: "date"}
+	},
+	reflect.TypeOf(gift.Unclaimed): func() *Schema {
+		return &Schema{Type: "string", Enum: []string{gift.Unclaimed.String(), gift.Reserved.String(), gift.Purchased.String(), gift.Delivered.String()}}
+	},
+	// Snapshots of whatever the audit entry is about
+	reflect.TypeOf(json.RawMessage{}): func() *Schema {
+		return &Schema{Type: "object"}
+	},
+}
+
+// generator builds schemas from Go types by reflection, following their json
+// tags. Named structs become components, which are referred to by name.
+type generator struct {
+	schemas map[string]*Schema
+	types   map[string]reflect.Type
+}
+
+func newGenerator() *generator {
+	return &generator{schemas: map[string]*Schema{}, types: map[string]reflect.Type{}}
+}
+
+// schemaOf returns the schema for v, which is either a *Schema already or a
+// value whose type describes the JSON.
+func (g *generator) schemaOf(v interface{}) *Schema {
+	if s, ok := v.(*Schema); ok {
+		return s
+	}
+	return g.schema(reflect.TypeOf(v))
+}
+
+func (g *generator) schema(t reflect.Type) *Schema {
+	if f, ok := special[t]; ok {
+		return f()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return boolean()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return integer()
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return str()
+	case reflect.Slice, reflect.Array:
+		return arrayOf(g.schema(t.Elem()))
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Interface:
+		return &Schema{}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return g.object(t)
+		}
+		return g.component(t)
+	}
+	panic(fmt.Sprintf("openapi: no schema for %v", t))
+}
+
+func (g *generator) component(t reflect.Type) *Schema {
+	name := t.Name()
+	if existing, ok := g.types[name]; ok && existing != t {
+		panic(fmt.Sprintf("openapi: %v and %v are both called %s", existing, t, name))
+	}
+	if _, ok := g.types[name]; !ok {
+		// Registered before the fields so recursive types terminate
+		g.types[name] = t
+		g.schemas[name] = g.object(t)
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func (g *generator) object(t reflect.Type) *Schema {
+	properties := map[string]*Schema{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; len(tagName) > 0 {
+				name = tagName
+			}
+		}
+		properties[name] = g.schema(field.Type)
+	}
+	return object(properties)
+}
@@ -0,0 +1,207 @@
+package profile
+
+import (
+	authHelper "github.com/mrbbot/gift-list-api/auth"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"firebase.google.com/go/auth"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// uidPrefix starts the UIDs of managed profiles so they can't clash with
+// Firebase UIDs, which are alphanumeric.
+const uidPrefix = "managed-"
+
+// Profile is someone without their own account, such as a young child, whose
+// lists are managed by a parent. They have their own UID, which is used as the
+// owner of their lists, and share their parent's friends.
+type Profile struct {
+	UID     string    `json:"uid"`
+	Parent  string    `json:"parent"`
+	Name    string    `json:"name"`
+	Photo   string    `json:"photo,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func generateUID() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return uidPrefix + hex.EncodeToString(b), nil
+}
+
+func getProfile(ctx context.Context, db *sql.DB, uid string) (Profile, error) {
+	var profile Profile
+	err := db.QueryRowContext(ctx, "SELECT uid, parent, name, photo, created_at FROM profiles WHERE uid = ?", uid).Scan(
+		&profile.UID, &profile.Parent, &profile.Name, &profile.Photo, &profile.Created)
+	return profile, err
+}
+
+// GetManaged returns the profiles a user manages.
+func GetManaged(ctx context.Context, db *sql.DB, parent string) ([]Profile, error) {
+	profiles := []Profile{}
+	rows, err := db.QueryContext(ctx, "SELECT uid, parent, name, photo, created_at FROM profiles WHERE parent = ? ORDER BY id", parent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var profile Profile
+		err := rows.Scan(&profile.UID, &profile.Parent, &profile.Name, &profile.Photo, &profile.Created)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
+
+// Lookup returns the user record for a UID, which is made up from the profile
+// for managed profiles.
+func Lookup(ctx context.Context, db *sql.DB, uid string) (*auth.UserRecord, error) {
+	profile, err := getProfile(ctx, db, uid)
+	if err == sql.ErrNoRows {
+		return authHelper.UserFromUID(ctx, uid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: profile.UID, DisplayName: profile.Name, PhotoURL: profile.Photo}}, nil
+}
+
+func GetProfiles(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	profiles, err := GetManaged(ctx, db, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
+
+func CreateProfile(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	var profile Profile
+	json.NewDecoder(r.Body).Decode(&profile)
+	if len(profile.Name) == 0 {
+		util.EncodeBadRequest(w, "name is required")
+		return
+	}
+
+	// Profiles can't manage profiles of their own
+	manager, err := util.GetManager(ctx, db, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if manager != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	profile.UID, err = generateUID()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	profile.Parent = user.UID
+	profile.Created = time.Now().UTC()
+
+	_, err = db.ExecContext(ctx, "INSERT INTO profiles (uid, parent, name, photo, created_at) VALUES (?, ?, ?, ?, ?)", profile.UID, profile.Parent, profile.Name, profile.Photo, profile.Created)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func EditProfile(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	uid := params["profileId"]
+
+	profile, err := getProfile(ctx, db, uid)
+	if err == sql.ErrNoRows {
+		util.EncodeNotFound(w)
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if profile.Parent != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	var newProfile Profile
+	json.NewDecoder(r.Body).Decode(&newProfile)
+	if len(newProfile.Name) > 0 {
+		profile.Name = newProfile.Name
+	}
+	if len(newProfile.Photo) > 0 {
+		profile.Photo = newProfile.Photo
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE profiles SET name = ?, photo = ? WHERE uid = ?", profile.Name, profile.Photo, profile.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// RemoveProfile deletes a managed profile. Its lists have to be removed first.
+func RemoveProfile(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	uid := params["profileId"]
+
+	profile, err := getProfile(ctx, db, uid)
+	if err == sql.ErrNoRows {
+		util.EncodeNotFound(w)
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if profile.Parent != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	var lists int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM lists WHERE owner = ? AND deleted_at IS NULL", uid).Scan(&lists)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if lists > 0 {
+		util.EncodeBadRequest(w, "profile still has lists")
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM profiles WHERE uid = ?", uid)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(util.Response{Success: true})
+}
@@ -0,0 +1,58 @@
+package purge
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+const interval = time.Hour
+
+// Init starts permanently deleting lists, gifts and friendships once they've
+// been deleted for longer than util.UndoWindow, and invites once they've been
+// expired or revoked for as long.
+func Init(db *sql.DB) {
+	ctx := context.Background()
+	go func() {
+		for {
+			err := run(ctx, db, time.Now().UTC().Add(-util.UndoWindow))
+			if err != nil {
+				log.Printf("error purging deleted rows: %v\n", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func run(ctx context.Context, db *sql.DB, cutoff time.Time) error {
+	// Gifts and sharing go first so that none are left behind without a list
+	queries := []string{
+		"DELETE gifts FROM gifts, lists WHERE lists.id = gifts.list_id AND lists.deleted_at < ?",
+		"DELETE list_circles FROM list_circles, lists WHERE lists.id = list_circles.list_id AND lists.deleted_at < ?",
+		"DELETE FROM gifts WHERE deleted_at < ?",
+		"DELETE FROM lists WHERE deleted_at < ?",
+		"DELETE FROM friendships WHERE deleted_at < ?",
+		"DELETE FROM invites WHERE expires_at < ? OR revoked_at < ?",
+	}
+	for _, query := range queries {
+		args := make([]interface{}, strings.Count(query, "?"))
+		for i := range args {
+			args[i] = cutoff
+		}
+		res, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected > 0 {
+			log.Printf("purged %d rows: %s\n", rowsAffected, query)
+		}
+	}
+	return nil
+}
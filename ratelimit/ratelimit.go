@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Rule is a token bucket: Limit requests can be made at once, and the bucket
+// refills at Limit per Period. Rules are told apart by Name, so the same key
+// gets a separate bucket for each rule.
+type Rule struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+// Limiter counts requests against rules.
+type Limiter interface {
+	// Allow takes a token from key's bucket for rule. If it's empty, it returns
+	// false and how long until the next token is added.
+	Allow(rule Rule, key string) (bool, time.Duration)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// When the bucket will be full again, after which it can be forgotten
+	full time.Time
+}
+
+// Memory keeps buckets in memory, so limits are per server rather than shared
+// between replicas.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// sweepInterval is how often full buckets are removed.
+const sweepInterval = time.Minute
+
+// NewMemory returns an in-memory limiter, and starts removing full buckets in
+// the background as they're no different from new ones.
+func NewMemory() *Memory {
+	m := &Memory{buckets: map[string]*bucket{}}
+	go func() {
+		for {
+			time.Sleep(sweepInterval)
+			m.sweep(time.Now())
+		}
+	}()
+	return m
+}
+
+func (m *Memory) Allow(rule Rule, key string) (bool, time.Duration) {
+	if rule.Limit <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	rate := float64(rule.Limit) / rule.Period.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := rule.Name + "\xff" + key
+	b, ok := m.buckets[id]
+	if !ok {
+		b = &bucket{tokens: float64(rule.Limit), updated: now}
+		m.buckets[id] = b
+	}
+	b.tokens = math.Min(float64(rule.Limit), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(rule.Limit) - b.tokens) / rate * float64(time.Second)))
+	return true, 0
+}
+
+func (m *Memory) sweep(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, b := range m.buckets {
+		if now.After(b.full) {
+			delete(m.buckets, id)
+		}
+	}
+}
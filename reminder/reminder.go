@@ -0,0 +1,379 @@
+package reminder
+
+import (
+	"github.com/mrbbot/gift-list-api/event"
+	"github.com/mrbbot/gift-list-api/gift"
+	"github.com/mrbbot/gift-list-api/profile"
+	"github.com/mrbbot/gift-list-api/settings"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"firebase.google.com/go/auth"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	job          = "reminders"
+	tickInterval = time.Hour
+
+	kindOccasion = "occasion"
+	kindPurchase = "purchase"
+)
+
+type Reminder struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Subject   string    `json:"subject"`
+	Occasion  util.Date `json:"occasion"`
+	Message   string    `json:"message"`
+	Created   time.Time `json:"created"`
+	recipient string
+}
+
+type occasion struct {
+	subject   string
+	owner     string
+	listId    int64
+	listName  string
+	date      util.Date
+	unclaimed int
+}
+
+// Init starts the scheduler, which checks every hour whether today's
+// reminders have been sent yet. The last run is stored in the database, and
+// every reminder is recorded once, so restarts never send duplicates.
+func Init(db *sql.DB) {
+	ctx := context.Background()
+	go func() {
+		for {
+			err := tick(ctx, db)
+			if err != nil {
+				log.Printf("error sending reminders: %v\n", err)
+			}
+			time.Sleep(tickInterval)
+		}
+	}()
+}
+
+func tick(ctx context.Context, db *sql.DB) error {
+	today := util.Today()
+
+	var lastRun util.Date
+	err := db.QueryRowContext(ctx, "SELECT last_run FROM scheduler_runs WHERE job = ?", job).Scan(&lastRun)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && !lastRun.Before(today.Time) {
+		return nil
+	}
+
+	// Recorded even if the run failed, so a broken reminder isn't retried every
+	// hour all day. Any that were missed are sent tomorrow if they're still due.
+	runErr := run(ctx, db, today)
+	_, err = db.ExecContext(ctx, "INSERT INTO scheduler_runs (job, last_run) VALUES (?, ?) ON DUPLICATE KEY UPDATE last_run = VALUES(last_run)", job, today)
+	if runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+// run sends the day's reminders. Failures for a single occasion, recipient or
+// claim are logged and skipped so they don't hold up everyone else's, and only
+// failing to find what's due stops the run.
+func run(ctx context.Context, db *sql.DB, today util.Date) error {
+	names := map[string]string{}
+	name := func(uid string) (string, error) {
+		if n, ok := names[uid]; ok {
+			return n, nil
+		}
+		user, err := profile.Lookup(ctx, db, uid)
+		if err != nil {
+			return "", err
+		}
+		names[uid] = user.DisplayName
+		return user.DisplayName, nil
+	}
+
+	occasions, err := getOccasions(ctx, db, today)
+	if err != nil {
+		return err
+	}
+	for _, o := range occasions {
+		err := remindOccasion(ctx, db, today, o, name)
+		if err != nil {
+			log.Printf("error sending reminders for %s: %v\n", o.subject, err)
+		}
+	}
+
+	return remindPurchases(ctx, db, today, name)
+}
+
+// remindOccasion reminds the owner's friends who can see the list, or all of
+// them for a birthday, that the occasion is coming up.
+func remindOccasion(ctx context.Context, db *sql.DB, today util.Date, o occasion, name func(string) (string, error)) error {
+	var (
+		friends []string
+		err     error
+	)
+	if o.listId != 0 {
+		friends, err = util.GetListViewers(ctx, db, o.owner, o.listId)
+	} else {
+		friends, err = util.GetFriends(ctx, db, o.owner)
+	}
+	if err != nil {
+		return err
+	}
+	ownerName, err := name(o.owner)
+	if err != nil {
+		return err
+	}
+	days := today.DaysUntil(o.date)
+
+	var message string
+	if len(o.listName) == 0 {
+		message = fmt.Sprintf("%s's birthday is %s – %s", ownerName, inDays(days), unclaimedGifts(o.unclaimed))
+	} else {
+		message = fmt.Sprintf("%s's %s list is due %s – %s", ownerName, o.listName, inDays(days), unclaimedGifts(o.unclaimed))
+	}
+
+	for _, friend := range friends {
+		s, err := settings.Load(ctx, db, friend)
+		if err == nil && s.Reminders && days <= s.ReminderDays {
+			err = send(ctx, db, Reminder{Kind: kindOccasion, Subject: o.subject, Occasion: o.date, Message: message, recipient: friend})
+		}
+		if err != nil {
+			log.Printf("error reminding %s about %s: %v\n", friend, o.subject, err)
+		}
+	}
+	return nil
+}
+
+// getOccasions returns every list occasion and birthday in the next year, along
+// with the number of gifts nobody has claimed yet. Birthdays count the gifts on
+// lists without an occasion of their own.
+func getOccasions(ctx context.Context, db *sql.DB, today util.Date) ([]occasion, error) {
+	var occasions []occasion
+
+	rows, err := db.QueryContext(ctx, "SELECT id, name, owner, occasion FROM lists WHERE occasion >= ? AND occasion <= ? AND archived_at IS NULL AND deleted_at IS NULL", today, today.AddDays(365))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var o occasion
+		err := rows.Scan(&o.listId, &o.listName, &o.owner, &o.date)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		o.subject = "list:" + strconv.FormatInt(o.listId, 10)
+		occasions = append(occasions, o)
+	}
+	rows.Close()
+
+	for i := range occasions {
+		err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM gifts WHERE list_id = ? AND claim_status = ? AND archived_at IS NULL AND received_at IS NULL AND deleted_at IS NULL", occasions[i].listId, gift.Unclaimed).Scan(&occasions[i].unclaimed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT uid, birthday FROM users WHERE birthday IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	var birthdays []occasion
+	for rows.Next() {
+		var (
+			o        occasion
+			birthday util.Date
+		)
+		err := rows.Scan(&o.owner, &birthday)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		o.date = nextAnniversary(birthday, today)
+		o.subject = "birthday:" + o.owner
+		birthdays = append(birthdays, o)
+	}
+	rows.Close()
+
+	for i := range birthdays {
+		err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM lists, gifts WHERE lists.id = gifts.list_id AND lists.owner = ? AND lists.occasion IS NULL AND lists.archived_at IS NULL AND lists.deleted_at IS NULL AND gifts.claim_status = ? AND gifts.archived_at IS NULL AND gifts.received_at IS NULL AND gifts.deleted_at IS NULL", birthdays[i].owner, gift.Unclaimed).Scan(&birthdays[i].unclaimed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return append(occasions, birthdays...), nil
+}
+
+// claim is a gift that's been reserved but not bought yet.
+type claim struct {
+	giftId   int64
+	giftName string
+	claimer  string
+	listName string
+	owner    string
+	occasion *util.Date
+}
+
+// remindPurchases reminds claimers about gifts they've claimed but not bought
+// as the list's occasion, or the owner's birthday if it has none, approaches.
+func remindPurchases(ctx context.Context, db *sql.DB, today util.Date, name func(string) (string, error)) error {
+	var claims []claim
+
+	rows, err := db.QueryContext(ctx, "SELECT gifts.id, gifts.name, gifts.claimed_by, lists.name, lists.owner, lists.occasion FROM lists, gifts WHERE lists.id = gifts.list_id AND gifts.claim_status = ? AND lists.archived_at IS NULL AND lists.deleted_at IS NULL AND gifts.archived_at IS NULL AND gifts.deleted_at IS NULL", gift.Reserved)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c claim
+		err := rows.Scan(&c.giftId, &c.giftName, &c.claimer, &c.listName, &c.owner, &c.occasion)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		claims = append(claims, c)
+	}
+	rows.Close()
+
+	for _, c := range claims {
+		err := remindPurchase(ctx, db, today, c, name)
+		if err != nil {
+			log.Printf("error reminding %s about gift:%d: %v\n", c.claimer, c.giftId, err)
+		}
+	}
+	return nil
+}
+
+func remindPurchase(ctx context.Context, db *sql.DB, today util.Date, c claim, name func(string) (string, error)) error {
+	var date util.Date
+	if c.occasion != nil {
+		date = *c.occasion
+	} else {
+		ownerSettings, err := settings.Load(ctx, db, c.owner)
+		if err != nil {
+			return err
+		}
+		if ownerSettings.Birthday == nil {
+			return nil
+		}
+		date = nextAnniversary(*ownerSettings.Birthday, today)
+	}
+
+	days := today.DaysUntil(date)
+	if days < 0 {
+		return nil
+	}
+	s, err := settings.Load(ctx, db, c.claimer)
+	if err != nil {
+		return err
+	}
+	if !s.Reminders || days > s.ReminderDays {
+		return nil
+	}
+
+	ownerName, err := name(c.owner)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("You claimed %s on %s's %s list but haven't marked it purchased – it's needed %s", c.giftName, ownerName, c.listName, inDays(days))
+	return send(ctx, db, Reminder{Kind: kindPurchase, Subject: "gift:" + strconv.FormatInt(c.giftId, 10), Occasion: date, Message: message, recipient: c.claimer})
+}
+
+// send records the reminder and publishes it, unless the recipient has already
+// been sent the same reminder for this occasion.
+func send(ctx context.Context, db *sql.DB, reminder Reminder) error {
+	reminder.Created = time.Now().UTC()
+	res, err := db.ExecContext(ctx, "INSERT IGNORE INTO reminders (recipient, kind, subject, occasion, message, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		reminder.recipient, reminder.Kind, reminder.Subject, reminder.Occasion, reminder.Message, reminder.Created)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return err
+	}
+	reminder.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	eventType := event.ReminderOccasion
+	if reminder.Kind == kindPurchase {
+		eventType = event.ReminderPurchase
+	}
+	event.Publish(event.Event{Type: eventType, Target: reminder.recipient, Data: reminder})
+	return nil
+}
+
+func nextAnniversary(date util.Date, today util.Date) util.Date {
+	next := util.Date{Time: time.Date(today.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)}
+	if next.Before(today.Time) {
+		next = util.Date{Time: next.AddDate(1, 0, 0)}
+	}
+	return next
+}
+
+func inDays(days int) string {
+	switch {
+	case days == 0:
+		return "today"
+	case days == 1:
+		return "tomorrow"
+	case days == 7:
+		return "in 1 week"
+	case days%7 == 0:
+		return fmt.Sprintf("in %d weeks", days/7)
+	default:
+		return fmt.Sprintf("in %d days", days)
+	}
+}
+
+func unclaimedGifts(count int) string {
+	if count == 1 {
+		return "1 unclaimed gift"
+	}
+	return fmt.Sprintf("%d unclaimed gifts", count)
+}
+
+// GetReminders returns reminders sent to the user, newest first.
+func GetReminders(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	reminders := []Reminder{}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, kind, subject, occasion, message, created_at FROM reminders WHERE recipient = ? AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?", user.UID, page.Cursor, page.Cursor, page.Limit)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reminder Reminder
+		err := rows.Scan(&reminder.ID, &reminder.Kind, &reminder.Subject, &reminder.Occasion, &reminder.Message, &reminder.Created)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		reminders = append(reminders, reminder)
+	}
+
+	if len(reminders) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(reminders), reminders[len(reminders)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reminders)
+}
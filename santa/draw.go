@@ -0,0 +1,86 @@
+package santa
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	mathRand "math/rand"
+	"sort"
+)
+
+var (
+	errNoDraw       = errors.New("no draw is possible with these exclusions")
+	errAlreadyDrawn = errors.New("group has already been drawn")
+)
+
+// newSeed returns a random seed that fits in a JSON number without losing
+// precision.
+func newSeed() (int64, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b) >> 11), nil
+}
+
+// draw assigns every member a recipient other than themselves, never pairing
+// members excluded from drawing each other. The same members, exclusions and
+// seed always give the same assignments, whatever order the members are in.
+// Finding recipients is a bipartite matching between givers and recipients, so
+// errNoDraw is only returned if there really is no valid draw.
+func draw(members []string, exclusions [][]string, seed int64) (map[string]string, error) {
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+	rng := mathRand.New(mathRand.NewSource(seed))
+
+	excluded := map[[2]string]bool{}
+	for _, pair := range exclusions {
+		excluded[[2]string{pair[0], pair[1]}] = true
+		excluded[[2]string{pair[1], pair[0]}] = true
+	}
+
+	// Shuffling the candidates makes the matching random
+	n := len(sorted)
+	candidates := make([][]int, n)
+	for giver := range sorted {
+		for _, recipient := range rng.Perm(n) {
+			if recipient != giver && !excluded[[2]string{sorted[giver], sorted[recipient]}] {
+				candidates[giver] = append(candidates[giver], recipient)
+			}
+		}
+	}
+
+	// givers maps each recipient to their giver, or -1 if they don't have one yet
+	givers := make([]int, n)
+	for i := range givers {
+		givers[i] = -1
+	}
+	for _, giver := range rng.Perm(n) {
+		if !augment(giver, candidates, givers, make([]bool, n)) {
+			return nil, errNoDraw
+		}
+	}
+
+	assignments := map[string]string{}
+	for recipient, giver := range givers {
+		assignments[sorted[giver]] = sorted[recipient]
+	}
+	return assignments, nil
+}
+
+// augment finds giver a recipient, moving earlier givers on to other
+// recipients if it has to. It reports false if that isn't possible.
+func augment(giver int, candidates [][]int, givers []int, seen []bool) bool {
+	for _, recipient := range candidates[giver] {
+		if seen[recipient] {
+			continue
+		}
+		seen[recipient] = true
+		if givers[recipient] < 0 || augment(givers[recipient], candidates, givers, seen) {
+			givers[recipient] = giver
+			return true
+		}
+	}
+	return false
+}
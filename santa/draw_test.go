@@ -0,0 +1,180 @@
+package santa
+
+import (
+	"fmt"
+	mathRand "math/rand"
+	"reflect"
+	"testing"
+)
+
+// checkDraw fails the test unless assignments give every member exactly one
+// recipient other than themselves, and nobody draws someone they're excluded
+// from.
+func checkDraw(t *testing.T, members []string, exclusions [][]string, assignments map[string]string) {
+	t.Helper()
+	excluded := map[[2]string]bool{}
+	for _, pair := range exclusions {
+		excluded[[2]string{pair[0], pair[1]}] = true
+		excluded[[2]string{pair[1], pair[0]}] = true
+	}
+	if len(assignments) != len(members) {
+		t.Fatalf("got %d assignments for %d members: %v", len(assignments), len(members), assignments)
+	}
+	received := map[string]bool{}
+	for _, giver := range members {
+		recipient, ok := assignments[giver]
+		if !ok {
+			t.Fatalf("%s has no recipient: %v", giver, assignments)
+		}
+		if recipient == giver {
+			t.Fatalf("%s drew themselves: %v", giver, assignments)
+		}
+		if excluded[[2]string{giver, recipient}] {
+			t.Fatalf("%s drew %s, who they're excluded from: %v", giver, recipient, assignments)
+		}
+		if received[recipient] {
+			t.Fatalf("%s was drawn twice: %v", recipient, assignments)
+		}
+		received[recipient] = true
+	}
+}
+
+func TestDraw(t *testing.T) {
+	tests := []struct {
+		name       string
+		members    []string
+		exclusions [][]string
+	}{
+		{"pair", []string{"a", "b"}, nil},
+		{"three", []string{"a", "b", "c"}, nil},
+		{"many", []string{"a", "b", "c", "d", "e", "f", "g", "h"}, nil},
+		{"couples", []string{"a", "b", "c", "d"}, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"one couple", []string{"a", "b", "c", "d"}, [][]string{{"a", "b"}}},
+		{"everyone but one", []string{"a", "b", "c", "d", "e"}, [][]string{{"a", "b"}, {"a", "c"}, {"a", "d"}}},
+		{"crowded", []string{"a", "b", "c", "d", "e", "f"}, [][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}, {"a", "c"}, {"b", "e"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A tight set of exclusions mustn't only work for lucky seeds
+			for seed := int64(0); seed < 100; seed++ {
+				assignments, err := draw(test.members, test.exclusions, seed)
+				if err != nil {
+					t.Fatalf("seed %d: %v", seed, err)
+				}
+				checkDraw(t, test.members, test.exclusions, assignments)
+			}
+		})
+	}
+}
+
+func TestDrawImpossible(t *testing.T) {
+	tests := []struct {
+		name       string
+		members    []string
+		exclusions [][]string
+	}{
+		{"alone", []string{"a"}, nil},
+		{"excluded pair", []string{"a", "b"}, [][]string{{"a", "b"}}},
+		{"couple of three", []string{"a", "b", "c"}, [][]string{{"a", "b"}}},
+		{"excluded from everyone", []string{"a", "b", "c"}, [][]string{{"a", "b"}, {"a", "c"}}},
+		{"two excluded from everyone else", []string{"a", "b", "c", "d"}, [][]string{{"a", "c"}, {"a", "d"}, {"b", "c"}, {"b", "d"}, {"a", "b"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := draw(test.members, test.exclusions, 1)
+			if err != errNoDraw {
+				t.Fatalf("got %v, want errNoDraw", err)
+			}
+		})
+	}
+}
+
+func TestDrawReproducible(t *testing.T) {
+	members := []string{"a", "b", "c", "d", "e", "f"}
+	exclusions := [][]string{{"a", "b"}, {"c", "d"}}
+	want, err := draw(members, exclusions, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reordered := []string{"f", "c", "a", "e", "b", "d"}
+	swapped := [][]string{{"d", "c"}, {"b", "a"}}
+	got, err := draw(reordered, swapped, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Different seeds should give different draws, or the seed isn't used
+	same := 0
+	for seed := int64(0); seed < 20; seed++ {
+		other, err := draw(members, exclusions, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(other, want) {
+			same++
+		}
+	}
+	if same == 20 {
+		t.Error("every seed gave the same draw")
+	}
+}
+
+// possible reports whether any valid draw exists, by trying every permutation.
+func possible(members []string, excluded map[[2]string]bool) bool {
+	n := len(members)
+	used := make([]bool, n)
+	var try func(giver int) bool
+	try = func(giver int) bool {
+		if giver == n {
+			return true
+		}
+		for recipient := 0; recipient < n; recipient++ {
+			if used[recipient] || recipient == giver || excluded[[2]string{members[giver], members[recipient]}] {
+				continue
+			}
+			used[recipient] = true
+			if try(giver + 1) {
+				return true
+			}
+			used[recipient] = false
+		}
+		return false
+	}
+	return try(0)
+}
+
+func TestDrawOnlyFailsWhenImpossible(t *testing.T) {
+	rng := mathRand.New(mathRand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		n := 2 + rng.Intn(5)
+		members := make([]string, n)
+		for j := range members {
+			members[j] = fmt.Sprintf("m%d", j)
+		}
+		var exclusions [][]string
+		excluded := map[[2]string]bool{}
+		for a := 0; a < n; a++ {
+			for b := a + 1; b < n; b++ {
+				if rng.Intn(3) == 0 {
+					exclusions = append(exclusions, []string{members[a], members[b]})
+					excluded[[2]string{members[a], members[b]}] = true
+					excluded[[2]string{members[b], members[a]}] = true
+				}
+			}
+		}
+
+		assignments, err := draw(members, exclusions, rng.Int63())
+		if possible(members, excluded) {
+			if err != nil {
+				t.Fatalf("%v with exclusions %v: %v", members, exclusions, err)
+			}
+			checkDraw(t, members, exclusions, assignments)
+		} else if err != errNoDraw {
+			t.Fatalf("%v with exclusions %v: got %v, want errNoDraw", members, exclusions, err)
+		}
+	}
+}
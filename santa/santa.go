@@ -0,0 +1,706 @@
+package santa
+
+import (
+	"github.com/mrbbot/gift-list-api/list"
+	"github.com/mrbbot/gift-list-api/profile"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"firebase.google.com/go/auth"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+const (
+	minMembers = 3
+	maxMembers = 100
+)
+
+// Group is a Secret Santa group. Once it's been drawn each member can only see
+// who they're buying for, until the organiser reveals all the assignments.
+type Group struct {
+	ID        int64    `json:"id"`
+	Name      string   `json:"name"`
+	Organiser string   `json:"organiser"`
+	Budget    int      `json:"budget"`
+	Currency  string   `json:"currency,omitempty"`
+	Members   []string `json:"members"`
+	// Pairs of members who can't draw each other, only shown to the organiser
+	Exclusions [][]string `json:"exclusions,omitempty"`
+	Drawn      *time.Time `json:"drawn,omitempty"`
+	Revealed   *time.Time `json:"revealed,omitempty"`
+	// The seed and assignments (giver to recipient) are only shown once the
+	// organiser has revealed them
+	Seed        *int64            `json:"seed,omitempty"`
+	Assignments map[string]string `json:"assignments,omitempty"`
+	Created     time.Time         `json:"created"`
+}
+
+type Recipient struct {
+	UID   string      `json:"uid"`
+	Name  string      `json:"name"`
+	Photo string      `json:"photo,omitempty"`
+	Lists []list.List `json:"lists"`
+}
+
+func getGroup(ctx context.Context, db *sql.DB, id interface{}) (Group, error) {
+	var group Group
+	var seed sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT id, name, organiser, budget, currency, seed, drawn_at, revealed_at, created_at FROM santa_groups WHERE id = ?", id).Scan(
+		&group.ID, &group.Name, &group.Organiser, &group.Budget, &group.Currency, &seed, &group.Drawn, &group.Revealed, &group.Created)
+	if err != nil {
+		return group, err
+	}
+	if group.Revealed != nil && seed.Valid {
+		group.Seed = &seed.Int64
+	}
+	group.Members, err = getMembers(ctx, db, group.ID)
+	if err != nil {
+		return group, err
+	}
+	group.Exclusions, err = getExclusions(ctx, db, group.ID)
+	if err != nil {
+		return group, err
+	}
+	if group.Revealed != nil {
+		group.Assignments, err = getAssignments(ctx, db, group.ID)
+	}
+	return group, err
+}
+
+func getMembers(ctx context.Context, q util.Querier, groupId int64) ([]string, error) {
+	members := []string{}
+	rows, err := q.QueryContext(ctx, "SELECT member FROM santa_members WHERE group_id = ? ORDER BY member", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member string
+		err := rows.Scan(&member)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func getExclusions(ctx context.Context, q util.Querier, groupId int64) ([][]string, error) {
+	exclusions := [][]string{}
+	rows, err := q.QueryContext(ctx, "SELECT a, b FROM santa_exclusions WHERE group_id = ? ORDER BY a, b", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a, b string
+		err := rows.Scan(&a, &b)
+		if err != nil {
+			return nil, err
+		}
+		exclusions = append(exclusions, []string{a, b})
+	}
+	return exclusions, rows.Err()
+}
+
+func getAssignments(ctx context.Context, db *sql.DB, groupId int64) (map[string]string, error) {
+	assignments := map[string]string{}
+	rows, err := db.QueryContext(ctx, "SELECT giver, recipient FROM santa_assignments WHERE group_id = ?", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var giver, recipient string
+		err := rows.Scan(&giver, &recipient)
+		if err != nil {
+			return nil, err
+		}
+		assignments[giver] = recipient
+	}
+	return assignments, rows.Err()
+}
+
+func (group Group) hasMember(uid string) bool {
+	for _, member := range group.Members {
+		if member == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleTo returns the group as uid should see it, hiding the exclusions from
+// everyone but the organiser, and members blocked either way from uid.
+func (group Group) visibleTo(uid string, blocked map[string]bool) Group {
+	if uid != group.Organiser {
+		group.Exclusions = nil
+	}
+	if len(blocked) == 0 {
+		return group
+	}
+	members := []string{}
+	for _, member := range group.Members {
+		if !blocked[member] {
+			members = append(members, member)
+		}
+	}
+	group.Members = members
+	if group.Exclusions != nil {
+		exclusions := [][]string{}
+		for _, pair := range group.Exclusions {
+			if !blocked[pair[0]] && !blocked[pair[1]] {
+				exclusions = append(exclusions, pair)
+			}
+		}
+		group.Exclusions = exclusions
+	}
+	if group.Assignments != nil {
+		assignments := map[string]string{}
+		for giver, recipient := range group.Assignments {
+			if !blocked[giver] && !blocked[recipient] {
+				assignments[giver] = recipient
+			}
+		}
+		group.Assignments = assignments
+	}
+	return group
+}
+
+// getBlocked returns the users uid has blocked or been blocked by.
+func getBlocked(ctx context.Context, db *sql.DB, uid string) (map[string]bool, error) {
+	blocked := map[string]bool{}
+	rows, err := db.QueryContext(ctx, "SELECT IF(owner = ?, blocked, owner) FROM blocks WHERE owner = ? OR blocked = ?", uid, uid, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var other string
+		err := rows.Scan(&other)
+		if err != nil {
+			return nil, err
+		}
+		blocked[other] = true
+	}
+	return blocked, rows.Err()
+}
+
+// getBlockedPairs returns pairs of the group's members where one has blocked
+// the other, so they can be kept from drawing each other.
+func getBlockedPairs(ctx context.Context, q util.Querier, groupId int64) ([][]string, error) {
+	pairs := [][]string{}
+	rows, err := q.QueryContext(ctx, "SELECT owner, blocked FROM blocks WHERE owner IN (SELECT member FROM santa_members WHERE group_id = ?) AND blocked IN (SELECT member FROM santa_members WHERE group_id = ?)", groupId, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var owner, blocked string
+		err := rows.Scan(&owner, &blocked)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, []string{owner, blocked})
+	}
+	return pairs, rows.Err()
+}
+
+// writeGroup writes the group as the user should see it.
+func writeGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token, group Group) {
+	blocked, err := getBlocked(r.Context(), db, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group.visibleTo(user.UID, blocked))
+}
+
+// getVisibleGroup returns the group in the URL if the user organises it or is
+// a member of it, otherwise writing the error response and returning false.
+func getVisibleGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) (Group, bool) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	group, err := getGroup(ctx, db, params["groupId"])
+	if err == sql.ErrNoRows {
+		util.EncodeNotFound(w)
+		return group, false
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return group, false
+	}
+	if group.Organiser != user.UID && !group.hasMember(user.UID) {
+		util.EncodeNotFound(w)
+		return group, false
+	}
+	return group, true
+}
+
+// checkMembers returns a message explaining what's wrong with the members and
+// exclusions, or an empty string if they're fine. Members must be the organiser
+// or their accepted friends, and managed profiles can't take part as they
+// can't sign in to see who they've drawn.
+func checkMembers(ctx context.Context, db *sql.DB, organiser string, members []string, exclusions [][]string) (string, error) {
+	set := map[string]bool{}
+	for _, member := range members {
+		set[member] = true
+	}
+	if len(set) != len(members) {
+		return "members must be unique", nil
+	}
+	if len(members) < minMembers || len(members) > maxMembers {
+		return "groups must have between 3 and 100 members", nil
+	}
+	for _, member := range members {
+		areFriends, err := util.AreFriends(ctx, db, organiser, member)
+		if err != nil {
+			return "", err
+		}
+		manager, err := util.GetManager(ctx, db, member)
+		if err != nil {
+			return "", err
+		}
+		if !areFriends || manager != member {
+			return "members must be friends", nil
+		}
+	}
+	for _, pair := range exclusions {
+		if len(pair) != 2 || pair[0] == pair[1] || !set[pair[0]] || !set[pair[1]] {
+			return "exclusions must be pairs of members", nil
+		}
+	}
+	return "", nil
+}
+
+// setMembers replaces the group's members and exclusions. It should be run in
+// a transaction so the group is never left with only some of them.
+func setMembers(ctx context.Context, q util.Querier, groupId int64, members []string, exclusions [][]string) error {
+	_, err := q.ExecContext(ctx, "DELETE FROM santa_members WHERE group_id = ?", groupId)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "DELETE FROM santa_exclusions WHERE group_id = ?", groupId)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		_, err := q.ExecContext(ctx, "INSERT INTO santa_members (group_id, member) VALUES (?, ?)", groupId, member)
+		if err != nil {
+			return err
+		}
+	}
+	for _, pair := range exclusions {
+		_, err := q.ExecContext(ctx, "INSERT IGNORE INTO santa_exclusions (group_id, a, b) VALUES (?, ?, ?)", groupId, pair[0], pair[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGroups returns the groups the user organises or is a member of.
+func GetGroups(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	var ids []int64
+	rows, err := db.QueryContext(ctx, "SELECT id FROM santa_groups WHERE (organiser = ? OR id IN (SELECT group_id FROM santa_members WHERE member = ?)) AND id > ? ORDER BY id LIMIT ?", user.UID, user.UID, page.Cursor, page.Limit)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	blocked, err := getBlocked(ctx, db, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	groups := []Group{}
+	for _, id := range ids {
+		group, err := getGroup(ctx, db, id)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		groups = append(groups, group.visibleTo(user.UID, blocked))
+	}
+
+	if len(groups) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(groups), groups[len(groups)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+func GetGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	group, ok := getVisibleGroup(w, r, db, user)
+	if !ok {
+		return
+	}
+
+	writeGroup(w, r, db, user, group)
+}
+
+// CreateGroup creates a group organised by the user. The organiser only takes
+// part in the draw if they include themselves in the members.
+func CreateGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	var group Group
+	json.NewDecoder(r.Body).Decode(&group)
+	if len(group.Name) == 0 {
+		util.EncodeBadRequest(w, "name is required")
+		return
+	}
+	if group.Budget < 0 {
+		util.EncodeBadRequest(w, "budget can't be negative")
+		return
+	}
+	message, err := checkMembers(ctx, db, user.UID, group.Members, group.Exclusions)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if len(message) > 0 {
+		util.EncodeBadRequest(w, message)
+		return
+	}
+
+	created := time.Now().UTC()
+	var id int64
+	err = util.Transact(ctx, db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "INSERT INTO santa_groups (organiser, name, budget, currency, created_at) VALUES (?, ?, ?, ?, ?)", user.UID, group.Name, group.Budget, group.Currency, created)
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return setMembers(ctx, tx, id, group.Members, group.Exclusions)
+	})
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	group, err = getGroup(ctx, db, id)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	writeGroup(w, r, db, user, group)
+}
+
+// EditGroup updates a group's name, budget, members and exclusions. The members
+// and exclusions can't be changed once the group has been drawn.
+func EditGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	group, ok := getVisibleGroup(w, r, db, user)
+	if !ok {
+		return
+	}
+	if group.Organiser != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	var newGroup Group
+	json.NewDecoder(r.Body).Decode(&newGroup)
+	if len(newGroup.Name) > 0 {
+		group.Name = newGroup.Name
+	}
+	if newGroup.Budget < 0 {
+		util.EncodeBadRequest(w, "budget can't be negative")
+		return
+	}
+	if newGroup.Budget > 0 {
+		group.Budget = newGroup.Budget
+	}
+	if len(newGroup.Currency) > 0 {
+		group.Currency = newGroup.Currency
+	}
+
+	changesMembers := newGroup.Members != nil || newGroup.Exclusions != nil
+	if changesMembers {
+		if group.Drawn != nil {
+			util.EncodeBadRequest(w, errAlreadyDrawn.Error())
+			return
+		}
+		if newGroup.Members != nil {
+			group.Members = newGroup.Members
+		}
+		if newGroup.Exclusions != nil {
+			group.Exclusions = newGroup.Exclusions
+		}
+		message, err := checkMembers(ctx, db, user.UID, group.Members, group.Exclusions)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		if len(message) > 0 {
+			util.EncodeBadRequest(w, message)
+			return
+		}
+	}
+
+	err := util.Transact(ctx, db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE santa_groups SET name = ?, budget = ?, currency = ? WHERE id = ?", group.Name, group.Budget, group.Currency, group.ID)
+		if err != nil || !changesMembers {
+			return err
+		}
+		// A draw could have started since the group was read
+		var drawn *time.Time
+		err = tx.QueryRowContext(ctx, "SELECT drawn_at FROM santa_groups WHERE id = ? FOR UPDATE", group.ID).Scan(&drawn)
+		if err != nil {
+			return err
+		}
+		if drawn != nil {
+			return errAlreadyDrawn
+		}
+		return setMembers(ctx, tx, group.ID, group.Members, group.Exclusions)
+	})
+	if err == errAlreadyDrawn {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	group, err = getGroup(ctx, db, group.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	writeGroup(w, r, db, user, group)
+}
+
+func RemoveGroup(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	group, ok := getVisibleGroup(w, r, db, user)
+	if !ok {
+		return
+	}
+	if group.Organiser != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	for _, query := range []string{
+		"DELETE FROM santa_assignments WHERE group_id = ?",
+		"DELETE FROM santa_exclusions WHERE group_id = ?",
+		"DELETE FROM santa_members WHERE group_id = ?",
+		"DELETE FROM santa_groups WHERE id = ?",
+	} {
+		_, err := db.ExecContext(ctx, query, group.ID)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(util.Response{Success: true})
+}
+
+// Draw assigns every member of the group someone to buy for, from a random
+// seed that's kept secret until the group is revealed, so the organiser can't
+// work out who drew who. Groups can only be drawn once.
+func Draw(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	group, ok := getVisibleGroup(w, r, db, user)
+	if !ok {
+		return
+	}
+	if group.Organiser != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+	if group.Drawn != nil {
+		util.EncodeBadRequest(w, errAlreadyDrawn.Error())
+		return
+	}
+
+	seed, err := newSeed()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	var message string
+	err = util.Transact(ctx, db, func(tx *sql.Tx) error {
+		// Locked so the members can't be edited and no other draw can start
+		// until this one is saved
+		var drawn *time.Time
+		err := tx.QueryRowContext(ctx, "SELECT drawn_at FROM santa_groups WHERE id = ? FOR UPDATE", group.ID).Scan(&drawn)
+		if err != nil {
+			return err
+		}
+		if drawn != nil {
+			return errAlreadyDrawn
+		}
+		members, err := getMembers(ctx, tx, group.ID)
+		if err != nil {
+			return err
+		}
+		exclusions, err := getExclusions(ctx, tx, group.ID)
+		if err != nil {
+			return err
+		}
+
+		// Members might have unfriended the organiser since joining
+		message, err = checkMembers(ctx, db, user.UID, members, exclusions)
+		if err != nil || len(message) > 0 {
+			return err
+		}
+
+		// Members who've blocked each other can't draw each other either, without
+		// the organiser finding out. They aren't stored with the exclusions, so
+		// the revealed seed doesn't reproduce a draw they changed
+		blockedPairs, err := getBlockedPairs(ctx, tx, group.ID)
+		if err != nil {
+			return err
+		}
+		assignments, err := draw(members, append(exclusions, blockedPairs...), seed)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE santa_groups SET seed = ?, drawn_at = ? WHERE id = ?", seed, time.Now().UTC(), group.ID)
+		if err != nil {
+			return err
+		}
+		for giver, recipient := range assignments {
+			_, err := tx.ExecContext(ctx, "INSERT INTO santa_assignments (group_id, giver, recipient) VALUES (?, ?, ?)", group.ID, giver, recipient)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == errAlreadyDrawn || err == errNoDraw {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if len(message) > 0 {
+		util.EncodeBadRequest(w, message)
+		return
+	}
+
+	group, err = getGroup(ctx, db, group.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	writeGroup(w, r, db, user, group)
+}
+
+// Reveal shows everyone in the group, including the organiser, who drew who.
+func Reveal(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	group, ok := getVisibleGroup(w, r, db, user)
+	if !ok {
+		return
+	}
+	if group.Organiser != user.UID {
+		util.EncodeUnauthorised(w)
+		return
+	}
+	if group.Drawn == nil {
+		util.EncodeBadRequest(w, "group hasn't been drawn yet")
+		return
+	}
+
+	_, err := db.ExecContext(ctx, "UPDATE santa_groups SET revealed_at = ? WHERE id = ? AND revealed_at IS NULL", time.Now().UTC(), group.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	group, err = getGroup(ctx, db, group.ID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	writeGroup(w, r, db, user, group)
+}
+
+// GetRecipient returns who the user is buying for and their lists. Members
+// don't have to be friends with their recipient to see their lists, but lists
+// shared with circles they aren't in stay hidden, as do all of them if either
+// has blocked the other, and claims are never shown.
+func GetRecipient(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	group, ok := getVisibleGroup(w, r, db, user)
+	if !ok {
+		return
+	}
+	if !group.hasMember(user.UID) {
+		util.EncodeUnauthorised(w)
+		return
+	}
+
+	var recipient Recipient
+	err := db.QueryRowContext(ctx, "SELECT recipient FROM santa_assignments WHERE group_id = ? AND giver = ?", group.ID, user.UID).Scan(&recipient.UID)
+	if err == sql.ErrNoRows {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "group hasn't been drawn yet"})
+		return
+	}
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	record, err := profile.Lookup(ctx, db, recipient.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	recipient.Name = record.DisplayName
+	recipient.Photo = record.PhotoURL
+	// A block after the draw doesn't change who the user is buying for, but
+	// their lists stay hidden
+	blocked, err := util.IsBlocked(ctx, db, user.UID, recipient.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	recipient.Lists = []list.List{}
+	if !blocked {
+		recipient.Lists, err = list.GetSharedLists(ctx, db, recipient.UID, user.UID)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recipient)
+}
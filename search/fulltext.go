@@ -0,0 +1,75 @@
+package search
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"github.com/go-sql-driver/mysql"
+	"log"
+	"strings"
+	"sync"
+)
+
+// FullText searches with MySQL FULLTEXT indexes, matching each term as a word
+// prefix. It needs the indexes added by migrations/008_search.sql, and falls
+// back to Scan until they've been added.
+type FullText struct{}
+
+var warnMissingIndex sync.Once
+
+// missingIndex reports whether err is MySQL complaining that there's no
+// FULLTEXT index for a MATCH.
+func missingIndex(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1191
+}
+
+func (FullText) Search(ctx context.Context, db *sql.DB, viewer string, owners []string, terms []string, after *Cursor, limit int) ([]Result, error) {
+	against := strings.Join(terms, "* ") + "*"
+	in := "?" + strings.Repeat(", ?", len(owners)-1)
+
+	query := "SELECT kind, list_id, list_name, owner, gift_id, name, description, score FROM (" +
+		"SELECT 'list' AS kind, lists.id AS id, lists.id AS list_id, lists.name AS list_name, lists.owner AS owner, 0 AS gift_id, lists.name AS name, '' AS description, MATCH(lists.name) AGAINST(? IN BOOLEAN MODE) AS score FROM lists WHERE lists.owner IN (" + in + ") AND lists.deleted_at IS NULL AND lists.archived_at IS NULL AND " + util.ListVisibleTo + " AND MATCH(lists.name) AGAINST(? IN BOOLEAN MODE)" +
+		" UNION ALL " +
+		"SELECT 'gift', gifts.id, lists.id, lists.name, lists.owner, gifts.id, gifts.name, gifts.description, MATCH(gifts.name, gifts.description) AGAINST(? IN BOOLEAN MODE) FROM lists, gifts WHERE lists.id = gifts.list_id AND lists.owner IN (" + in + ") AND lists.deleted_at IS NULL AND lists.archived_at IS NULL AND " + util.ListVisibleTo + " AND gifts.deleted_at IS NULL AND gifts.archived_at IS NULL AND MATCH(gifts.name, gifts.description) AGAINST(? IN BOOLEAN MODE)" +
+		") AS results"
+	args := make([]interface{}, 0, 2*len(owners)+16)
+	args = append(args, against)
+	for _, owner := range owners {
+		args = append(args, owner)
+	}
+	args = append(args, viewer, viewer, viewer, against, against)
+	for _, owner := range owners {
+		args = append(args, owner)
+	}
+	args = append(args, viewer, viewer, viewer, against)
+	if after != nil {
+		query += " WHERE score < ? OR (score = ? AND (kind > ? OR (kind = ? AND id > ?)))"
+		args = append(args, after.Score, after.Score, after.Type, after.Type, after.ID)
+	}
+	query += " ORDER BY score DESC, kind, id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if missingIndex(err) {
+		warnMissingIndex.Do(func() {
+			log.Println("FULLTEXT indexes are missing, searching with scan until migrations/008_search.sql is applied")
+		})
+		return Scan{}.Search(ctx, db, viewer, owners, terms, after, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []Result
+	for rows.Next() {
+		var result Result
+		err := rows.Scan(&result.Type, &result.ListID, &result.ListName, &result.Owner, &result.GiftID, &result.Name, &result.Description, &result.Score)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
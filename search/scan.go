@@ -0,0 +1,78 @@
+package search
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+// Scan searches by reading every visible list and gift and matching terms
+// anywhere in them. It works on any SQL store, so it's useful where FULLTEXT
+// indexes aren't available, but it's only suitable for small data sets. Matches
+// in names count twice as much as matches in descriptions.
+type Scan struct{}
+
+func (Scan) Search(ctx context.Context, db *sql.DB, viewer string, owners []string, terms []string, after *Cursor, limit int) ([]Result, error) {
+	pattern := termPattern(terms)
+	score := func(name string, description string) float64 {
+		return float64(2*len(pattern.FindAllStringIndex(name, -1)) + len(pattern.FindAllStringIndex(description, -1)))
+	}
+
+	in := "?" + strings.Repeat(", ?", len(owners)-1)
+	args := make([]interface{}, 0, len(owners)+3)
+	for _, owner := range owners {
+		args = append(args, owner)
+	}
+	args = append(args, viewer, viewer, viewer)
+
+	var results []Result
+
+	rows, err := db.QueryContext(ctx, "SELECT lists.id, lists.name, lists.owner FROM lists WHERE lists.owner IN ("+in+") AND lists.deleted_at IS NULL AND lists.archived_at IS NULL AND "+util.ListVisibleTo, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		result := Result{Type: TypeList}
+		err := rows.Scan(&result.ListID, &result.Name, &result.Owner)
+		if err != nil {
+			return nil, err
+		}
+		result.ListName = result.Name
+		if result.Score = score(result.Name, ""); result.Score > 0 && (after == nil || after.Before(cursorOf(result))) {
+			results = append(results, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	giftRows, err := db.QueryContext(ctx, "SELECT lists.id, lists.name, lists.owner, gifts.id, gifts.name, gifts.description FROM lists, gifts WHERE lists.id = gifts.list_id AND lists.owner IN ("+in+") AND lists.deleted_at IS NULL AND lists.archived_at IS NULL AND "+util.ListVisibleTo+" AND gifts.deleted_at IS NULL AND gifts.archived_at IS NULL", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer giftRows.Close()
+	for giftRows.Next() {
+		result := Result{Type: TypeGift}
+		err := giftRows.Scan(&result.ListID, &result.ListName, &result.Owner, &result.GiftID, &result.Name, &result.Description)
+		if err != nil {
+			return nil, err
+		}
+		if result.Score = score(result.Name, result.Description); result.Score > 0 && (after == nil || after.Before(cursorOf(result))) {
+			results = append(results, result)
+		}
+	}
+	if err := giftRows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return cursorOf(results[i]).Before(cursorOf(results[j]))
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,246 @@
+package search
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"firebase.google.com/go/auth"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	TypeList = "list"
+	TypeGift = "gift"
+
+	// Only this many words of a query are used
+	maxTerms = 10
+	// Highlighted descriptions are cut down to about this many characters
+	snippetLength = 160
+)
+
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+type Result struct {
+	Type        string            `json:"type"`
+	ListID      int64             `json:"listId"`
+	ListName    string            `json:"listName"`
+	Owner       string            `json:"owner"`
+	GiftID      int64             `json:"giftId,omitempty"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Score       float64           `json:"score"`
+	Highlights  map[string]string `json:"highlights"`
+}
+
+// id is what ties results with the same score and type together.
+func (result Result) id() int64 {
+	if result.Type == TypeGift {
+		return result.GiftID
+	}
+	return result.ListID
+}
+
+// Cursor is the last result of a page. Results are ranked by score, best first,
+// then by type and ID, so the next page is the results ranked after it.
+type Cursor struct {
+	Score float64
+	Type  string
+	ID    int64
+}
+
+func cursorOf(result Result) Cursor {
+	return Cursor{Score: result.Score, Type: result.Type, ID: result.id()}
+}
+
+// Before reports whether c is ranked before other.
+func (c Cursor) Before(other Cursor) bool {
+	if c.Score != other.Score {
+		return c.Score > other.Score
+	}
+	if c.Type != other.Type {
+		return c.Type < other.Type
+	}
+	return c.ID < other.ID
+}
+
+func (c Cursor) encode() string {
+	value := strconv.FormatFloat(c.Score, 'g', -1, 64) + ":" + c.Type + ":" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func parseCursor(value string) (*Cursor, error) {
+	invalid := errors.New("invalid cursor")
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, invalid
+	}
+	parts := strings.Split(string(decoded), ":")
+	if len(parts) != 3 || (parts[1] != TypeList && parts[1] != TypeGift) {
+		return nil, invalid
+	}
+	var c Cursor
+	c.Type = parts[1]
+	c.Score, err = strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, invalid
+	}
+	c.ID, err = strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+	return &c, nil
+}
+
+// Backend finds the lists and gifts owned by owners that match terms and that
+// viewer can see, in the order Cursor describes, starting after the given
+// cursor if it isn't nil. Archived and removed lists and gifts are never
+// returned.
+type Backend interface {
+	Search(ctx context.Context, db *sql.DB, viewer string, owners []string, terms []string, after *Cursor, limit int) ([]Result, error)
+}
+
+var backend Backend = FullText{}
+
+// Use replaces the backend used for searching. MySQL FULLTEXT is used by
+// default.
+func Use(b Backend) {
+	backend = b
+}
+
+// terms splits a query into lower case words, dropping any punctuation.
+func terms(q string) []string {
+	words := wordPattern.FindAllString(strings.ToLower(q), -1)
+	if len(words) > maxTerms {
+		words = words[:maxTerms]
+	}
+	return words
+}
+
+func termPattern(terms []string) *regexp.Regexp {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+}
+
+// highlight escapes text as HTML and wraps each match in <mark> tags. Long text
+// is cut down to the part around the first match.
+func highlight(text string, pattern *regexp.Regexp) (string, bool) {
+	matches := pattern.FindAllStringIndex(text, -1)
+	if len(matches) == 0 {
+		return "", false
+	}
+
+	start, end := 0, len(text)
+	if utf8.RuneCountInString(text) > snippetLength {
+		start = matches[0][0]
+		for i := 0; i < snippetLength/4 && start > 0; i++ {
+			_, size := utf8.DecodeLastRuneInString(text[:start])
+			start -= size
+		}
+		end = start
+		for i := 0; i < snippetLength && end < len(text); i++ {
+			_, size := utf8.DecodeRuneInString(text[end:])
+			end += size
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	last := start
+	for _, match := range matches {
+		if match[0] < last || match[1] > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:match[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[match[0]:match[1]]))
+		b.WriteString("</mark>")
+		last = match[1]
+	}
+	b.WriteString(html.EscapeString(text[last:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+func addHighlights(results []Result, terms []string) {
+	pattern := termPattern(terms)
+	for i := range results {
+		result := &results[i]
+		result.Highlights = map[string]string{}
+		fields := map[string]string{"name": result.Name, "description": result.Description}
+		if result.Type == TypeGift {
+			fields["listName"] = result.ListName
+		}
+		for field, text := range fields {
+			if highlighted, ok := highlight(text, pattern); ok {
+				result.Highlights[field] = highlighted
+			}
+		}
+	}
+}
+
+// Search returns the lists and gifts the user can see that match the q query
+// parameter, best match first. Scores aren't IDs, so the cursor for the next
+// page is the last result's position in the ranking rather than util.Page's.
+func Search(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	limit, err := util.ParseLimit(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+	var after *Cursor
+	if value := r.URL.Query().Get("cursor"); len(value) > 0 {
+		after, err = parseCursor(value)
+		if err != nil {
+			util.EncodeBadRequest(w, err.Error())
+			return
+		}
+	}
+	terms := terms(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		util.EncodeBadRequest(w, "q must contain at least one word")
+		return
+	}
+
+	owners, err := util.GetFriends(ctx, db, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	owners, err = util.WithProfiles(ctx, db, append(owners, user.UID))
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	results, err := backend.Search(ctx, db, user.UID, owners, terms, after, limit)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	if results == nil {
+		results = []Result{}
+	}
+	addHighlights(results, terms)
+
+	if len(results) == limit {
+		w.Header().Set(util.NextCursorHeader, cursorOf(results[len(results)-1]).encode())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,82 @@
+package settings
+
+import (
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"firebase.google.com/go/auth"
+	"net/http"
+)
+
+const DefaultReminderDays = 14
+
+type Settings struct {
+	Birthday     *util.Date `json:"birthday,omitempty"`
+	ReminderDays int        `json:"reminderDays"`
+	Reminders    bool       `json:"reminders"`
+}
+
+type settingsUpdate struct {
+	Birthday     *util.Date `json:"birthday"`
+	ReminderDays *int       `json:"reminderDays"`
+	Reminders    *bool      `json:"reminders"`
+}
+
+// Load returns a user's settings, falling back to the defaults if they've never
+// changed them.
+func Load(ctx context.Context, db *sql.DB, uid string) (Settings, error) {
+	s := Settings{ReminderDays: DefaultReminderDays, Reminders: true}
+	err := db.QueryRowContext(ctx, "SELECT birthday, reminder_days, reminders FROM users WHERE uid = ?", uid).Scan(&s.Birthday, &s.ReminderDays, &s.Reminders)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	return s, err
+}
+
+func GetSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	s, err := Load(ctx, db, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func EditSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	s, err := Load(ctx, db, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	var update settingsUpdate
+	json.NewDecoder(r.Body).Decode(&update)
+	if update.Birthday != nil {
+		s.Birthday = update.Birthday
+	}
+	if update.ReminderDays != nil {
+		if *update.ReminderDays < 0 || *update.ReminderDays > 365 {
+			util.EncodeBadRequest(w, "reminderDays must be between 0 and 365")
+			return
+		}
+		s.ReminderDays = *update.ReminderDays
+	}
+	if update.Reminders != nil {
+		s.Reminders = *update.Reminders
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO users (uid, birthday, reminder_days, reminders) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE birthday = VALUES(birthday), reminder_days = VALUES(reminder_days), reminders = VALUES(reminders)",
+		user.UID, s.Birthday, s.ReminderDays, s.Reminders)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
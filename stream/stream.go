@@ -0,0 +1,148 @@
+package stream
+
+import (
+	"github.com/mrbbot/gift-list-api/event"
+	"github.com/mrbbot/gift-list-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"firebase.google.com/go/auth"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const keepAliveInterval = 30 * time.Second
+
+type client struct {
+	uid    string
+	owner  string
+	events chan event.Event
+}
+
+var (
+	mu      sync.RWMutex
+	clients = map[*client]bool{}
+
+	// closing is closed when the server starts shutting down
+	closing   = make(chan struct{})
+	closeOnce sync.Once
+)
+
+// Close ends every open stream so the server can shut down without waiting
+// for clients to disconnect. Clients are expected to reconnect.
+func Close() {
+	closeOnce.Do(func() {
+		close(closing)
+	})
+}
+
+// Init subscribes to published events and fans them out to connected clients
+// that are allowed to see them.
+func Init(db *sql.DB) {
+	ctx := context.Background()
+	event.Subscribe(func(e event.Event) {
+		mu.RLock()
+		empty := len(clients) == 0
+		mu.RUnlock()
+		if empty {
+			return
+		}
+
+		audience, err := event.Audience(ctx, db, e)
+		if err != nil {
+			log.Printf("error streaming %s: %v\n", e.Type, err)
+			return
+		}
+		allowed := map[string]bool{}
+		for _, uid := range audience {
+			allowed[uid] = true
+		}
+
+		mu.RLock()
+		defer mu.RUnlock()
+		for c := range clients {
+			if !allowed[c.uid] || (len(c.owner) > 0 && !e.IsFriend() && !e.IsReminder() && c.owner != e.Owner) {
+				continue
+			}
+			select {
+			case c.events <- e:
+			default:
+				log.Printf("dropping %s for slow stream client %s\n", e.Type, c.uid)
+			}
+		}
+	})
+}
+
+// Stream sends events as Server-Sent Events until the client disconnects. An
+// optional owner query parameter limits list and gift events to that user's
+// lists.
+func Stream(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.EncodeError(w, errors.New("streaming unsupported"))
+		return
+	}
+
+	owner := r.URL.Query().Get("owner")
+	if len(owner) > 0 {
+		areFriends, err := util.AreFriends(ctx, db, user.UID, owner)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		if !areFriends {
+			util.EncodeUnauthorised(w)
+			return
+		}
+	}
+
+	c := &client{uid: user.UID, owner: owner, events: make(chan event.Event, 16)}
+	mu.Lock()
+	clients[c] = true
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		delete(clients, c)
+		mu.Unlock()
+	}()
+
+	// Streams stay open for much longer than the server's write timeout
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Printf("error clearing stream write deadline: %v\n", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-closing:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case e := <-c.events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("error encoding %s: %v\n", e.Type, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Date is a calendar day without a time, encoded as "YYYY-MM-DD" in JSON.
+type Date struct {
+	time.Time
+}
+
+func Today() Date {
+	now := time.Now().UTC()
+	return Date{time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)}
+}
+
+func (d Date) AddDays(days int) Date {
+	return Date{d.Time.AddDate(0, 0, days)}
+}
+
+// DaysUntil returns the number of whole days from d to other.
+func (d Date) DaysUntil(other Date) int {
+	return int(other.Time.Sub(d.Time).Hours() / 24)
+}
+
+func (d Date) String() string {
+	return d.Format(dateLayout)
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return err
+	}
+	d.Time = t
+	return nil
+}
+
+func (d *Date) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case time.Time:
+		d.Time = time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC)
+	case []byte:
+		t, err := time.Parse(dateLayout, string(v))
+		if err != nil {
+			return err
+		}
+		d.Time = t
+	case string:
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return err
+		}
+		d.Time = t
+	default:
+		return fmt.Errorf("cannot scan %T into Date", value)
+	}
+	return nil
+}
+
+func (d Date) Value() (driver.Value, error) {
+	return d.String(), nil
+}
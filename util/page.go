@@ -0,0 +1,80 @@
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+
+	// NextCursorHeader holds the cursor for the next page of a collection, and
+	// is only set when the page was full, so there may be more.
+	NextCursorHeader = "X-Next-Cursor"
+)
+
+// Page is a request for the items after Cursor. A zero Cursor starts from the
+// beginning.
+type Page struct {
+	Limit  int
+	Cursor int64
+}
+
+// ParsePage reads the limit and cursor query parameters.
+func ParsePage(r *http.Request) (Page, error) {
+	return ParsePageWith(r, "cursor")
+}
+
+// ParsePageWith reads the limit query parameter and the cursor from the named
+// parameter, for endpoints that return more than one collection.
+func ParsePageWith(r *http.Request, cursorParam string) (Page, error) {
+	limit, err := ParseLimit(r)
+	page := Page{Limit: limit}
+	if err != nil {
+		return page, err
+	}
+
+	if value := r.URL.Query().Get(cursorParam); len(value) > 0 {
+		decoded, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return page, errors.New("invalid cursor")
+		}
+		page.Cursor, err = strconv.ParseInt(string(decoded), 10, 64)
+		if err != nil {
+			return page, errors.New("invalid cursor")
+		}
+	}
+
+	return page, nil
+}
+
+// ParseLimit reads just the limit query parameter, for endpoints with cursors
+// that aren't IDs.
+func ParseLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if len(value) == 0 {
+		return DefaultPageLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > MaxPageLimit {
+		return DefaultPageLimit, errors.New("limit must be between 1 and " + strconv.Itoa(MaxPageLimit))
+	}
+	return limit, nil
+}
+
+// EncodeCursor returns an opaque cursor that continues after the item with the
+// given ID.
+func EncodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+// WriteNextCursor sets header to the cursor after lastId if count items filled
+// the page. It must be called before the body is written.
+func WriteNextCursor(w http.ResponseWriter, header string, page Page, count int, lastId int64) {
+	if count == page.Limit {
+		w.Header().Set(header, EncodeCursor(lastId))
+	}
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx, so helpers can be used
+// inside and outside of transactions.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Transact runs fn in a transaction, committing it if fn succeeds and rolling
+// it back otherwise.
+func Transact(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsDuplicate reports whether err came from breaking a unique constraint.
+func IsDuplicate(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1062
+}
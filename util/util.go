@@ -1,53 +1,222 @@
 package util
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// UndoWindow is how long a deleted list, gift or friendship can be restored for
+// before it's purged for good.
+const UndoWindow = 24 * time.Hour
+
 type Response struct {
 	Success bool   `json:"success"`
 	Message string `json:"message,omitempty"`
 }
 
+// ErrorLogger is implemented by response writers that log why a request
+// failed along with the rest of the request.
+type ErrorLogger interface {
+	LogError(message string)
+}
+
+// LogError records why the request being written to by w failed, falling back
+// to the standard logger if w can't log it.
+func LogError(w http.ResponseWriter, message string) {
+	if logger, ok := w.(ErrorLogger); ok {
+		logger.LogError(message)
+		return
+	}
+	log.Println(message)
+}
+
+// EncodeError responds with a 500, or a 504 if the request ran out of time.
 func EncodeError(w http.ResponseWriter, err error) {
-	log.Printf("\t<- ERROR: %v", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		LogError(w, fmt.Sprintf("timeout: %v", err))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "request timed out"})
+		return
+	}
+	LogError(w, err.Error())
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusInternalServerError)
 	json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("%v", err)})
 }
 
 func EncodeUnauthorised(w http.ResponseWriter) {
-	log.Printf("\t<- UNAUTHORISED")
+	LogError(w, "unauthorised")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusUnauthorized)
 	json.NewEncoder(w).Encode(Response{Success: false, Message: "unauthorised"})
 }
 
 func EncodeNotFound(w http.ResponseWriter) {
-	log.Printf("\t<- NOT FOUND")
+	LogError(w, "not found")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusNotFound)
 	json.NewEncoder(w).Encode(Response{Success: false, Message: "not found"})
 }
 
-func GetListOwner(db *sql.DB, listId string) (string, error) {
-	var currentOwner string
-	err := db.QueryRow("SELECT owner FROM lists WHERE id = ?", listId).Scan(&currentOwner)
+func EncodeBadRequest(w http.ResponseWriter, message string) {
+	LogError(w, "bad request: "+message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(Response{Success: false, Message: message})
+}
+
+// RequestID returns the ID the client or proxy gave the request, if any.
+func RequestID(r *http.Request) string {
+	return r.Header.Get("X-Request-ID")
+}
+
+// GetListOwner returns the list's owner, and the user who manages it: the
+// parent if the owner is a managed profile, otherwise the owner themselves.
+func GetListOwner(ctx context.Context, db *sql.DB, listId string) (string, string, error) {
+	var currentOwner, manager string
+	err := db.QueryRowContext(ctx, "SELECT lists.owner, COALESCE(profiles.parent, lists.owner) FROM lists LEFT JOIN profiles ON profiles.uid = lists.owner WHERE lists.id = ? AND lists.deleted_at IS NULL", listId).Scan(&currentOwner, &manager)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	return currentOwner, nil
+	return currentOwner, manager, nil
 }
 
-func AreFriends(db *sql.DB, uidOne string, uidTwo string) (bool, error) {
+// GetManager returns the parent of a managed profile, or uid itself for
+// everyone else.
+func GetManager(ctx context.Context, db *sql.DB, uid string) (string, error) {
+	var parent string
+	err := db.QueryRowContext(ctx, "SELECT parent FROM profiles WHERE uid = ?", uid).Scan(&parent)
+	if err == sql.ErrNoRows {
+		return uid, nil
+	}
+	return parent, err
+}
+
+// WithProfiles returns uids along with the managed profiles of each of them.
+func WithProfiles(ctx context.Context, db *sql.DB, uids []string) ([]string, error) {
+	if len(uids) == 0 {
+		return uids, nil
+	}
+	args := make([]interface{}, len(uids))
+	for i, uid := range uids {
+		args[i] = uid
+	}
+	profiles, err := queryFriends(ctx, db, "SELECT uid FROM profiles WHERE parent IN (?"+strings.Repeat(", ?", len(uids)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	return append(uids, profiles...), nil
+}
+
+// notBlocked filters out friendships where either user has blocked the other.
+// Blocking removes the friendship anyway, this just makes sure of it.
+const notBlocked = " AND NOT EXISTS (SELECT 1 FROM blocks WHERE (blocks.owner = friendships.requester AND blocks.blocked = friendships.addressee) OR (blocks.owner = friendships.addressee AND blocks.blocked = friendships.requester))"
+
+// FriendshipBetween is a condition on the friendships table that holds for the
+// rows between two users, given as its first two parameters and then again as
+// its last two, whichever of them sent the request.
+const FriendshipBetween = "friendships.user_low = LEAST(?, ?) AND friendships.user_high = GREATEST(?, ?)"
+
+// friendsOf is a table of the accepted friends of the user given for all three
+// of its parameters, with a single friend column.
+const friendsOf = "(SELECT IF(friendships.requester = ?, friendships.addressee, friendships.requester) AS friend FROM friendships WHERE (friendships.requester = ? OR friendships.addressee = ?) AND friendships.status = 'accepted' AND friendships.deleted_at IS NULL" + notBlocked + ") AS friends"
+
+// AreFriends reports whether the users can see each other's lists. Managed
+// profiles share their parent's friends, and their parent can see their lists.
+func AreFriends(ctx context.Context, db *sql.DB, uidOne string, uidTwo string) (bool, error) {
 	if uidOne == uidTwo {
 		return true, nil
 	}
-	rows, err := db.Query("SELECT id FROM friends WHERE owner = ? AND friend = ? AND state = 1", uidOne, uidTwo)
+	uidOne, err := GetManager(ctx, db, uidOne)
+	if err != nil {
+		return false, err
+	}
+	uidTwo, err = GetManager(ctx, db, uidTwo)
+	if err != nil {
+		return false, err
+	}
+	if uidOne == uidTwo {
+		return true, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id FROM friendships WHERE "+FriendshipBetween+" AND status = 'accepted' AND deleted_at IS NULL"+notBlocked, uidOne, uidTwo, uidOne, uidTwo)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), nil
+}
+
+// GetFriends returns the UIDs of a user's friends. A managed profile's friends
+// are its parent's.
+func GetFriends(ctx context.Context, db *sql.DB, uid string) ([]string, error) {
+	uid, err := GetManager(ctx, db, uid)
+	if err != nil {
+		return nil, err
+	}
+	return queryFriends(ctx, db, "SELECT friend FROM "+friendsOf, uid, uid, uid)
+}
+
+// ListVisibleTo is a condition on the lists table that holds if the user given
+// for all three of its parameters is allowed to see the list as far as circles
+// are concerned. Owners and their parents can always see their lists, and
+// friends can unless the list is shared with circles they aren't in. It
+// doesn't check friendship.
+const ListVisibleTo = "(lists.owner = ? OR lists.owner IN (SELECT uid FROM profiles WHERE parent = ?) OR NOT EXISTS (SELECT 1 FROM list_circles WHERE list_circles.list_id = lists.id) OR EXISTS (SELECT 1 FROM list_circles, circle_members WHERE list_circles.list_id = lists.id AND circle_members.circle_id = list_circles.circle_id AND circle_members.member = ?))"
+
+// CanSeeList is AreFriends for a particular list, also checking that the list
+// is shared with one of the user's circles if it's shared with any.
+func CanSeeList(ctx context.Context, db *sql.DB, uid string, listId interface{}) (bool, error) {
+	var owner string
+	err := db.QueryRowContext(ctx, "SELECT owner FROM lists WHERE id = ? AND deleted_at IS NULL AND "+ListVisibleTo, listId, uid, uid, uid).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return AreFriends(ctx, db, uid, owner)
+}
+
+// GetListViewers returns the friends of owner who can see the list.
+func GetListViewers(ctx context.Context, db *sql.DB, owner string, listId int64) ([]string, error) {
+	owner, err := GetManager(ctx, db, owner)
+	if err != nil {
+		return nil, err
+	}
+	return queryFriends(ctx, db, "SELECT friend FROM "+friendsOf+
+		" WHERE (NOT EXISTS (SELECT 1 FROM list_circles WHERE list_circles.list_id = ?) OR EXISTS (SELECT 1 FROM list_circles, circle_members WHERE list_circles.list_id = ? AND circle_members.circle_id = list_circles.circle_id AND circle_members.member = friends.friend))",
+		owner, owner, owner, listId, listId)
+}
+
+func queryFriends(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	friends := []string{}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var friend string
+		err := rows.Scan(&friend)
+		if err != nil {
+			return nil, err
+		}
+		friends = append(friends, friend)
+	}
+	return friends, rows.Err()
+}
+
+// IsBlocked reports whether either user has blocked the other.
+func IsBlocked(ctx context.Context, q Querier, uidOne string, uidTwo string) (bool, error) {
+	rows, err := q.QueryContext(ctx, "SELECT id FROM blocks WHERE (owner = ? AND blocked = ?) OR (owner = ? AND blocked = ?)", uidOne, uidTwo, uidTwo, uidOne)
 	if err != nil {
 		return false, err
 	}
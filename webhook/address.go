@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var errPrivateAddress = errors.New("url must be on the public internet")
+
+// blockedNetworks aren't on the public internet, so webhooks can't be used to
+// reach the server's own network. Addresses in them can be written as IPv4
+// mapped IPv6 too, which Contains also matches.
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8",      // This network, including the unspecified address
+	"10.0.0.0/8",     // Private
+	"100.64.0.0/10",  // Carrier-grade NAT, which is just as internal as private
+	"127.0.0.0/8",    // Loopback
+	"169.254.0.0/16", // Link-local, including cloud metadata services
+	"172.16.0.0/12",  // Private
+	"192.0.0.0/24",   // Protocol assignments
+	"192.168.0.0/16", // Private
+	"198.18.0.0/15",  // Benchmarking
+	"224.0.0.0/4",    // Multicast
+	"240.0.0.0/4",    // Reserved, including broadcast
+	"::/128",         // Unspecified
+	"::1/128",        // Loopback
+	"64:ff9b::/96",   // NAT64, which embeds IPv4 addresses that can be private
+	"64:ff9b:1::/48", // Local-use NAT64
+	"fc00::/7",       // Unique local
+	"fe80::/10",      // Link-local
+	"ff00::/8",       // Multicast
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// isPublic reports whether ip is on the public internet rather than in any of
+// blockedNetworks.
+func isPublic(ip net.IP) bool {
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHost resolves host and returns errPrivateAddress if any of its addresses
+// aren't public. It only catches mistakes when a webhook is created, as the
+// host can resolve to something else by the time it's delivered to, which is
+// what checkDial is for.
+func checkHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return errors.New("url's host can't be found")
+	}
+	for _, addr := range addrs {
+		if !isPublic(addr.IP) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// checkDial stops connections to addresses that aren't public, after the host
+// has been resolved, so DNS can't be changed to point a webhook inside.
+func checkDial(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublic(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// newClient returns the client deliveries are made with. It never goes through
+// a proxy, which would hide the address being dialled, and doesn't follow
+// redirects, which could lead anywhere.
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
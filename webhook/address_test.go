@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"1.1.1.1", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"2606:4700:4700::1111", true},
+		{"64:ff9b:0:1::808:808", true},
+
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.0.0.1", false},
+		{"192.168.1.1", false},
+		{"198.18.0.1", false},
+		{"224.0.0.1", false},
+		{"239.255.255.250", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b:1::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"ff0e::1", false},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if ip == nil {
+			t.Fatalf("%s isn't an IP", test.ip)
+		}
+		if got := isPublic(ip); got != test.public {
+			t.Errorf("isPublic(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+func TestCheckDial(t *testing.T) {
+	if err := checkDial("tcp", "8.8.8.8:443", nil); err != nil {
+		t.Errorf("public address refused: %v", err)
+	}
+	for _, address := range []string{"127.0.0.1:80", "[::1]:80", "[64:ff9b::a9fe:a9fe]:80", "224.0.0.1:80"} {
+		if err := checkDial("tcp", address, nil); err != errPrivateAddress {
+			t.Errorf("checkDial(%s) = %v, want errPrivateAddress", address, err)
+		}
+	}
+}
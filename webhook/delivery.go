@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"github.com/mrbbot/gift-list-api/event"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	statusPending   = "pending"
+	statusDelivered = "delivered"
+	statusDead      = "dead"
+
+	maxAttempts  = 8
+	baseBackoff  = 10 * time.Second
+	maxBackoff   = time.Hour
+	pollInterval = 5 * time.Second
+	batchSize    = 50
+)
+
+var httpClient = newClient()
+
+// Init subscribes to published events and starts the delivery worker.
+func Init(db *sql.DB) {
+	ctx := context.Background()
+	event.Subscribe(func(e event.Event) {
+		err := enqueue(ctx, db, e)
+		if err != nil {
+			log.Printf("error queueing webhooks for %s: %v\n", e.Type, err)
+		}
+	})
+
+	go func() {
+		for range time.Tick(pollInterval) {
+			err := deliverDue(ctx, db)
+			if err != nil {
+				log.Printf("error delivering webhooks: %v\n", err)
+			}
+		}
+	}()
+}
+
+func enqueue(ctx context.Context, db *sql.DB, e event.Event) error {
+	audience, err := event.Audience(ctx, db, e)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, uid := range audience {
+		rows, err := db.QueryContext(ctx, "SELECT id, events FROM webhooks WHERE owner = ?", uid)
+		if err != nil {
+			return err
+		}
+
+		var ids []int64
+		for rows.Next() {
+			var (
+				id     int64
+				events string
+			)
+			err := rows.Scan(&id, &events)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if wants(splitEvents(events), e.Type) {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			_, err := db.ExecContext(ctx, "INSERT INTO webhook_deliveries (webhook_id, event, payload, attempts, status, last_error, next_attempt, created_at) VALUES (?, ?, ?, 0, ?, '', ?, ?)",
+				id, e.Type, string(payload), statusPending, now, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// wants reports whether a webhook subscribed to events should receive t. An
+// empty subscription receives everything.
+func wants(events []string, t string) bool {
+	if len(events) == 0 {
+		return true
+	}
+	for _, e := range events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+func deliverDue(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT webhook_deliveries.id, webhook_deliveries.event, webhook_deliveries.payload, webhook_deliveries.attempts, webhooks.url, webhooks.secret FROM webhooks, webhook_deliveries WHERE webhooks.id = webhook_deliveries.webhook_id AND webhook_deliveries.status = ? AND webhook_deliveries.next_attempt <= ? ORDER BY webhook_deliveries.next_attempt LIMIT ?",
+		statusPending, time.Now().UTC(), batchSize)
+	if err != nil {
+		return err
+	}
+
+	type due struct {
+		id       int64
+		event    string
+		payload  string
+		attempts int
+		url      string
+		secret   string
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		err := rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+
+	for _, d := range batch {
+		attempts := d.attempts + 1
+		err := send(d.url, d.secret, d.id, d.event, []byte(d.payload))
+		if err == nil {
+			_, err = db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = '' WHERE id = ?", statusDelivered, attempts, d.id)
+		} else if attempts >= maxAttempts {
+			log.Printf("webhook delivery %d dead after %d attempts: %v\n", d.id, attempts, err)
+			_, err = db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = ? WHERE id = ?", statusDead, attempts, err.Error(), d.id)
+		} else {
+			next := time.Now().UTC().Add(backoff(attempts))
+			_, err = db.ExecContext(ctx, "UPDATE webhook_deliveries SET attempts = ?, last_error = ?, next_attempt = ? WHERE id = ?", attempts, err.Error(), next, d.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backoff doubles the delay after every failed attempt, up to maxBackoff.
+func backoff(attempts int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+// Sign returns the value of the X-Webhook-Signature header for a payload, so
+// receivers can check it came from us.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func send(url string, secret string, id int64, eventType string, payload []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gift-list-api-webhooks")
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(id, 10))
+	req.Header.Set("X-Webhook-Signature", Sign(secret, payload))
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", strings.TrimSpace(res.Status))
+	}
+	return nil
+}
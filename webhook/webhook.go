@@ -0,0 +1,225 @@
+package webhook
+
+import (
+	"github.com/mrbbot/gift-list-api/event"
+	"github.com/mrbbot/gift-list-api/util"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"firebase.google.com/go/auth"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Webhook struct {
+	ID      int64     `json:"id"`
+	Owner   string    `json:"owner"`
+	Url     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type Delivery struct {
+	ID        int64     `json:"id"`
+	WebhookID int64     `json:"webhookId"`
+	Event     string    `json:"event"`
+	Payload   string    `json:"payload"`
+	Attempts  int       `json:"attempts"`
+	Status    string    `json:"status"`
+	LastError string    `json:"lastError,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func splitEvents(events string) []string {
+	if len(events) == 0 {
+		return []string{}
+	}
+	return strings.Split(events, ",")
+}
+
+func GetWebhooks(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	webhooks := []Webhook{}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, owner, url, events, created_at FROM webhooks WHERE owner = ? AND id > ? ORDER BY id LIMIT ?", user.UID, page.Cursor, page.Limit)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+		err := rows.Scan(&webhook.ID, &webhook.Owner, &webhook.Url, &events, &webhook.Created)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		webhook.Events = splitEvents(events)
+		webhooks = append(webhooks, webhook)
+	}
+
+	if len(webhooks) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(webhooks), webhooks[len(webhooks)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func CreateWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	var webhook Webhook
+	json.NewDecoder(r.Body).Decode(&webhook)
+	webhook.Owner = user.UID
+
+	u, err := url.Parse(webhook.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		util.EncodeBadRequest(w, "invalid url")
+		return
+	}
+	err = checkHost(ctx, u.Hostname())
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	for _, t := range webhook.Events {
+		if !event.IsType(t) {
+			util.EncodeBadRequest(w, "unknown event "+t)
+			return
+		}
+	}
+
+	webhook.Secret, err = generateSecret()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	webhook.Created = time.Now().UTC()
+
+	res, err := db.ExecContext(ctx, "INSERT INTO webhooks (owner, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?)",
+		webhook.Owner, webhook.Url, strings.Join(webhook.Events, ","), webhook.Secret, webhook.Created)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	webhook.ID, err = res.LastInsertId()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	// The secret is only ever returned here, so the caller must store it to verify signatures
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func RemoveWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["webhookId"]
+
+	res, err := db.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ? AND owner = ?", id, user.UID)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "webhook not found"})
+	}
+}
+
+// GetDeadLetters returns deliveries that gave up retrying, newest first.
+func GetDeadLetters(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	page, err := util.ParsePage(r)
+	if err != nil {
+		util.EncodeBadRequest(w, err.Error())
+		return
+	}
+
+	deliveries := []Delivery{}
+
+	rows, err := db.QueryContext(ctx, "SELECT webhook_deliveries.id, webhook_deliveries.webhook_id, webhook_deliveries.event, webhook_deliveries.payload, webhook_deliveries.attempts, webhook_deliveries.status, webhook_deliveries.last_error, webhook_deliveries.created_at FROM webhooks, webhook_deliveries WHERE webhooks.id = webhook_deliveries.webhook_id AND webhooks.owner = ? AND webhook_deliveries.status = ? AND (? = 0 OR webhook_deliveries.id < ?) ORDER BY webhook_deliveries.id DESC LIMIT ?", user.UID, statusDead, page.Cursor, page.Cursor, page.Limit)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var delivery Delivery
+		err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &delivery.Payload, &delivery.Attempts, &delivery.Status, &delivery.LastError, &delivery.Created)
+		if err != nil {
+			util.EncodeError(w, err)
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if len(deliveries) > 0 {
+		util.WriteNextCursor(w, util.NextCursorHeader, page, len(deliveries), deliveries[len(deliveries)-1].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func RetryDelivery(w http.ResponseWriter, r *http.Request, db *sql.DB, user *auth.Token) {
+	ctx := r.Context()
+	params := mux.Vars(r)
+	id := params["deliveryId"]
+
+	res, err := db.ExecContext(ctx, "UPDATE webhook_deliveries, webhooks SET webhook_deliveries.status = ?, webhook_deliveries.attempts = 0, webhook_deliveries.next_attempt = ? WHERE webhooks.id = webhook_deliveries.webhook_id AND webhooks.owner = ? AND webhook_deliveries.id = ? AND webhook_deliveries.status = ?",
+		statusPending, time.Now().UTC(), user.UID, id, statusDead)
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		util.EncodeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rowsAffected > 0 {
+		json.NewEncoder(w).Encode(util.Response{Success: true})
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(util.Response{Success: false, Message: "delivery not found"})
+	}
+}